@@ -0,0 +1,300 @@
+package binexec
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// modeExtract copies the binary out of the driver container instead
+	// of writing a wrapper entering it
+	modeExtract = "extract"
+
+	binaryModeLabel     = "io.rancher.network.cni.binary.mode"
+	binaryPathLabel     = "io.rancher.network.cni.binary.path"
+	binaryChecksumLabel = "io.rancher.network.cni.binary.sha256"
+
+	// prevSuffix is appended to the previous version of an extracted
+	// binary, kept for rollback
+	prevSuffix = ".prev"
+)
+
+var (
+	maxBinarySize   = int64(256 << 20)
+	maxSymlinkHops  = 5
+	checkCNITimeout = 10 * time.Second
+)
+
+// syncExtracted makes sure the binary extracted from a driver container is
+// installed. It's extracted again when the container restarts, when the
+// spec changes or when the installed files don't match anymore. The
+// installed binary is kept while the driver isn't running.
+func (w *Watcher) syncExtracted(name string, wr, current wrapper, state types.ContainerState) (wrapper, error) {
+	if state.Pid == 0 {
+		if current.Mode == modeExtract {
+			wr.StartedAt, wr.SHA256, wr.Dirs = current.StartedAt, current.SHA256, current.Dirs
+		}
+		return wr, nil
+	}
+
+	if current.Mode == modeExtract && reflect.DeepEqual(current.spec(), wr.spec()) && current.StartedAt == state.StartedAt &&
+		installed(name, wr.Dirs, current.SHA256) {
+		wr.StartedAt, wr.SHA256 = current.StartedAt, current.SHA256
+		return wr, nil
+	}
+
+	sum, err := w.extract(name, wr)
+	if err != nil {
+		if current.Mode == modeExtract {
+			return current, err
+		}
+		return wr, err
+	}
+
+	logrus.Infof("Extracted %s from driver container %s, sha256 %s", name, wr.ContainerID, sum)
+	wr.StartedAt, wr.SHA256 = state.StartedAt, sum
+	return wr, nil
+}
+
+// extract copies the binary out of the driver container, checks it and
+// installs it in every directory. The binary of a network driver has to
+// answer CNI VERSION, the previous version is restored otherwise.
+func (w *Watcher) extract(name string, wr wrapper) (string, error) {
+	src := wr.Source
+	if src == "" {
+		src = filepath.Join(binDir, name)
+	}
+
+	tmp, sum, err := w.copyFromContainer(wr.ContainerID, src, name)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	if wr.Checksum != "" && !strings.EqualFold(wr.Checksum, sum) {
+		return "", fmt.Errorf("checksum mismatch for %s, expected %s, got %s", src, wr.Checksum, sum)
+	}
+
+	for _, dir := range wr.Dirs {
+		if err := install(tmp, sum, dir, name); err != nil {
+			rollback(name, sum, wr.Dirs)
+			return "", err
+		}
+	}
+
+	if wr.Network {
+		if err := checkCNIBinary(filepath.Join(binDir, name)); err != nil {
+			rollback(name, sum, wr.Dirs)
+			return "", errors.Wrapf(err, "checking %s, rolled back to the previous version", name)
+		}
+	}
+
+	return sum, nil
+}
+
+// copyFromContainer writes the file at src in the container to a temp
+// file in binDir and returns its path and sha256. Symlinks are followed.
+func (w *Watcher) copyFromContainer(id, src, name string) (string, string, error) {
+	for i := 0; i < maxSymlinkHops; i++ {
+		rc, _, err := w.dc.CopyFromContainer(context.Background(), id, src)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "copying %s from container %s", src, id)
+		}
+
+		hdr, tr, err := firstEntry(rc)
+		if err != nil {
+			rc.Close()
+			return "", "", errors.Wrapf(err, "reading archive of %s", src)
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			rc.Close()
+			target := hdr.Linkname
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(src), target)
+			}
+			src = target
+			continue
+		}
+
+		tmp, sum, err := writeTemp(tr, hdr, name)
+		rc.Close()
+		return tmp, sum, err
+	}
+
+	return "", "", fmt.Errorf("too many levels of symlinks for %s", src)
+}
+
+func firstEntry(r io.Reader) (*tar.Header, *tar.Reader, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, tr, nil
+}
+
+func writeTemp(r io.Reader, hdr *tar.Header, name string) (string, string, error) {
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return "", "", fmt.Errorf("%s is not a regular file", hdr.Name)
+	}
+	if hdr.Size > maxBinarySize {
+		return "", "", fmt.Errorf("%s is too big, %d bytes", hdr.Name, hdr.Size)
+	}
+
+	f, err := ioutil.TempFile(binDir, "."+name+".extract")
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, maxBinarySize)); err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	if err := f.Sync(); err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	return f.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// install atomically replaces the binary in dir, after linking the
+// current one as the previous version
+func install(tmp, sum, dir, name string) error {
+	p := filepath.Join(dir, name)
+	if current, err := fileSHA256(p); err == nil && current == sum {
+		return nil
+	}
+
+	staged := filepath.Join(dir, "."+name+".new")
+	if err := copyFile(tmp, staged); err != nil {
+		return err
+	}
+
+	if fi, err := os.Lstat(p); err == nil && fi.Mode().IsRegular() && !isWrapper(p) {
+		os.Remove(p + prevSuffix)
+		if err := os.Link(p, p+prevSuffix); err != nil {
+			logrus.Warnf("Failed to keep the previous version of %s: %v", p, err)
+		}
+	}
+
+	if err := os.Rename(staged, p); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	logrus.Infof("Installed %s", p)
+	return nil
+}
+
+// rollback restores the previous version of a binary where there is one.
+// Where there is none, the binary with the given sha256 is removed.
+func rollback(name, sum string, dirs []string) {
+	for _, dir := range dirs {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p + prevSuffix); err != nil {
+			if current, err := fileSHA256(p); err == nil && current == sum {
+				logrus.Warnf("Removing %s, there is no previous version", p)
+				os.Remove(p)
+			}
+			continue
+		}
+		logrus.Warnf("Rolling back %s to the previous version", p)
+		if err := os.Rename(p+prevSuffix, p); err != nil {
+			logrus.Errorf("Failed to roll back %s: %v", p, err)
+		}
+	}
+}
+
+func installed(name string, dirs []string, sum string) bool {
+	if sum == "" {
+		return false
+	}
+	for _, dir := range dirs {
+		if current, err := fileSHA256(filepath.Join(dir, name)); err != nil || current != sum {
+			return false
+		}
+	}
+	return true
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkCNIBinary runs CNI VERSION, which every plugin implements
+func checkCNIBinary(p string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), checkCNITimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p)
+	cmd.Env = append(os.Environ(), "CNI_COMMAND=VERSION")
+	cmd.Stdin = strings.NewReader(`{"cniVersion": "0.1.0"}`)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("running VERSION: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	version := struct {
+		CNIVersion        string   `json:"cniVersion"`
+		SupportedVersions []string `json:"supportedVersions"`
+	}{}
+	if err := json.Unmarshal(out, &version); err != nil || (version.CNIVersion == "" && len(version.SupportedVersions) == 0) {
+		return fmt.Errorf("unexpected VERSION output %q", out)
+	}
+	return nil
+}
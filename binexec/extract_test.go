@@ -0,0 +1,80 @@
+package binexec
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testArchive(t *testing.T, content string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "rancher-bridge", Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("writing tar header: %v", err)
+	}
+	tw.Write([]byte(content))
+	tw.Close()
+	return buf
+}
+
+func extractTemp(t *testing.T, content string) (string, string) {
+	hdr, tr, err := firstEntry(testArchive(t, content))
+	if err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	tmp, sum, err := writeTemp(tr, hdr, "rancher-bridge")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return tmp, sum
+}
+
+func TestInstallAndRollback(t *testing.T) {
+	dir, cleanup := setupBinDir(t)
+	defer cleanup()
+	p := filepath.Join(dir, "rancher-bridge")
+
+	tmp, v1 := extractTemp(t, "v1")
+	defer os.Remove(tmp)
+	if v1 != "3bfc269594ef649228e9a74bab00f042efc91d5acc6fbee31a382e80d42388fe" {
+		t.Errorf("unexpected sha256 %s", v1)
+	}
+	if err := install(tmp, v1, dir, "rancher-bridge"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !installed("rancher-bridge", []string{dir}, v1) {
+		t.Fatalf("expected v1 to be installed")
+	}
+
+	tmp2, v2 := extractTemp(t, "v2")
+	defer os.Remove(tmp2)
+	if err := install(tmp2, v2, dir, "rancher-bridge"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(p + prevSuffix); string(content) != "v1" {
+		t.Errorf("expected v1 to be kept as the previous version, got %q", content)
+	}
+
+	rollback("rancher-bridge", v2, []string{dir})
+	if content, _ := ioutil.ReadFile(p); string(content) != "v1" {
+		t.Errorf("expected v1 after rollback, got %q", content)
+	}
+
+	// Nothing to roll back to, the bad binary is removed
+	rollback("rancher-bridge", v1, []string{dir})
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("expected the binary to be removed, got %v", err)
+	}
+}
+
+func TestWriteTempRejectsDirectories(t *testing.T) {
+	_, cleanup := setupBinDir(t)
+	defer cleanup()
+
+	if _, _, err := writeTemp(&bytes.Buffer{}, &tar.Header{Name: "bin", Typeflag: tar.TypeDir}, "bin"); err == nil {
+		t.Errorf("expected an error for a directory")
+	}
+}
@@ -0,0 +1,101 @@
+package binexec
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// manifestFile records the wrappers written by binexec, so that the
+	// ones of removed drivers can be cleaned up, even after a restart
+	manifestFile = ".binexec.json"
+)
+
+// wrapper is a binary set up for a driver container, either a script
+// entering the container or a binary extracted from it
+type wrapper struct {
+	ContainerID string `json:"containerId"`
+	// Mode is modeExtract for extracted binaries, empty for wrappers
+	Mode string `json:"mode,omitempty"`
+	// Source is the path of an extracted binary in the container
+	Source string `json:"source,omitempty"`
+	// Checksum is the expected sha256 of an extracted binary, if any
+	Checksum string `json:"checksum,omitempty"`
+	// Network is set for the binaries of network drivers, which are
+	// checked to be CNI plugins after extraction
+	Network bool `json:"network,omitempty"`
+	// PID the wrapper enters, 0 while the driver isn't running
+	PID int `json:"pid"`
+	// StartedAt and SHA256 of the container and binary last extracted
+	StartedAt string `json:"startedAt,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	// Dirs the binary was written to
+	Dirs []string `json:"dirs"`
+}
+
+// spec returns what's wanted for the binary, without the state of what
+// was set up
+func (wr wrapper) spec() wrapper {
+	return wrapper{
+		ContainerID: wr.ContainerID,
+		Mode:        wr.Mode,
+		Source:      wr.Source,
+		Checksum:    wr.Checksum,
+		Network:     wr.Network,
+	}
+}
+
+// manifest holds the wrappers owned by binexec by binary name
+type manifest map[string]wrapper
+
+func manifestPath() string {
+	return filepath.Join(binDir, manifestFile)
+}
+
+func loadManifest() (manifest, error) {
+	m := manifest{}
+	if err := readJSON(manifestPath(), &m); err != nil {
+		return manifest{}, err
+	}
+	return m, nil
+}
+
+func (m manifest) save() error {
+	return writeJSON(manifestPath(), m)
+}
+
+// readJSON leaves v untouched if there is no file at p
+func readJSON(p string, v interface{}) error {
+	content, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func writeJSON(p string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(p+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// isWrapper tells if the file at p is a wrapper script, binexec never
+// removes anything else
+func isWrapper(p string) bool {
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(string(content), "#!/bin/sh\n") && strings.Contains(string(content), "nsenter")
+}
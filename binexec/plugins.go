@@ -0,0 +1,308 @@
+package binexec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+)
+
+const (
+	// pluginLabel names the Docker plugin a storage driver container
+	// serves, its socket is found at pluginSocketLabel in the container
+	pluginLabel       = "io.rancher.storage.plugin"
+	pluginSocketLabel = "io.rancher.storage.plugin.socket"
+	// pluginFormatLabel is "spec" (default) or "json", the format of the
+	// discovery file
+	pluginFormatLabel = "io.rancher.storage.plugin.format"
+
+	pluginFormatJSON = "json"
+)
+
+var (
+	pluginSpecDir      = "/etc/docker/plugins"
+	pluginProxyDir     = "/run/rancher/docker-plugins"
+	pluginManifestFile = ".binexec-plugins.json"
+	procDir            = "/proc"
+)
+
+// plugin is a Docker plugin discovery file written for a driver container
+type plugin struct {
+	ContainerID string `json:"containerId"`
+	// Socket of the plugin in the container
+	Socket string `json:"socket"`
+	Format string `json:"format,omitempty"`
+	// PID the proxy enters, 0 while the driver isn't running
+	PID int `json:"pid"`
+	// Addr written in the discovery file
+	Addr    string `json:"addr,omitempty"`
+	Proxied bool   `json:"proxied,omitempty"`
+}
+
+func (p plugin) spec() plugin {
+	return plugin{
+		ContainerID: p.ContainerID,
+		Socket:      p.Socket,
+		Format:      p.Format,
+	}
+}
+
+// specFile returns the path of the discovery file of the plugin
+func (p plugin) specFile(name string) string {
+	if p.Format == pluginFormatJSON {
+		return filepath.Join(pluginSpecDir, name+".json")
+	}
+	return filepath.Join(pluginSpecDir, name+".spec")
+}
+
+func (p plugin) specContent(name string) ([]byte, error) {
+	if p.Format == pluginFormatJSON {
+		return json.Marshal(map[string]string{
+			"Name": name,
+			"Addr": p.Addr,
+		})
+	}
+	return []byte(p.Addr + "\n"), nil
+}
+
+func pluginManifestPath() string {
+	return filepath.Join(binDir, pluginManifestFile)
+}
+
+func loadPluginManifest() (map[string]plugin, error) {
+	m := map[string]plugin{}
+	if err := readJSON(pluginManifestPath(), &m); err != nil {
+		return map[string]plugin{}, err
+	}
+	return m, nil
+}
+
+// getPlugin returns the plugin served by a storage driver container, if any
+func getPlugin(labels map[string]string, id string) (string, plugin, bool) {
+	name := labels[pluginLabel]
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", plugin{}, false
+	}
+
+	socket := labels[pluginSocketLabel]
+	if socket == "" {
+		socket = fmt.Sprintf("/run/docker/plugins/%s.sock", name)
+	}
+
+	return name, plugin{
+		ContainerID: id,
+		Socket:      socket,
+		Format:      labels[pluginFormatLabel],
+	}, true
+}
+
+// syncPlugins writes the discovery files of the wanted plugins. A socket
+// bind mounted from the host is used directly, others are proxied through
+// a socket in pluginProxyDir. The plugins not wanted anymore are removed.
+// Must be called with the lock held.
+func (w *Watcher) syncPlugins(wanted map[string]plugin) error {
+	var lastErr error
+	for name, p := range wanted {
+		current, known := w.plugins[name]
+		container, err := w.dc.ContainerInspect(context.Background(), p.ContainerID)
+		if err != nil && !client.IsErrContainerNotFound(err) {
+			lastErr = err
+			if known {
+				wanted[name] = current
+			}
+			continue
+		}
+
+		if err != nil || container.State == nil || !container.State.Running {
+			// Keep the discovery file, the driver will likely come back
+			p.PID, p.Addr, p.Proxied = 0, current.Addr, current.Proxied
+			wanted[name] = p
+			continue
+		}
+		p.PID = container.State.Pid
+
+		if hostPath, ok := hostSocketPath(container.Mounts, p.Socket); ok {
+			w.stopProxy(name)
+			p.Addr = "unix://" + hostPath
+		} else {
+			proxyPath := filepath.Join(pluginProxyDir, name+".sock")
+			if err := w.startProxy(name, proxyPath); err != nil {
+				// Keep the discovery file, so that it can still be removed
+				lastErr = err
+				p.Addr, p.Proxied = current.Addr, current.Proxied
+				wanted[name] = p
+				continue
+			}
+			p.Addr, p.Proxied = "unix://"+proxyPath, true
+		}
+
+		if known && current.specFile(name) != p.specFile(name) {
+			removeSpecFile(name, current)
+		}
+		if err := writeSpecFile(name, p); err != nil {
+			lastErr = err
+		}
+		wanted[name] = p
+	}
+
+	for name, p := range w.plugins {
+		if _, ok := wanted[name]; !ok {
+			logrus.Infof("Removing Docker plugin %s of driver container %s which is gone", name, p.ContainerID)
+			w.stopProxy(name)
+			removeSpecFile(name, p)
+		}
+	}
+
+	w.plugins = wanted
+	if err := writeJSON(pluginManifestPath(), w.plugins); err != nil {
+		lastErr = err
+	}
+	return lastErr
+}
+
+// hostSocketPath returns the path of the socket on the host if it's in a
+// bind mount of the container
+func hostSocketPath(mounts []types.MountPoint, socket string) (string, bool) {
+	best := types.MountPoint{}
+	for _, m := range mounts {
+		if m.Type != "" && m.Type != "bind" {
+			continue
+		}
+		if (socket == m.Destination || strings.HasPrefix(socket, m.Destination+"/")) &&
+			len(m.Destination) > len(best.Destination) {
+			best = m
+		}
+	}
+	if best.Destination == "" {
+		return "", false
+	}
+	return best.Source + strings.TrimPrefix(socket, best.Destination), true
+}
+
+func writeSpecFile(name string, p plugin) error {
+	content, err := p.specContent(name)
+	if err != nil {
+		return err
+	}
+
+	f := p.specFile(name)
+	if current, err := ioutil.ReadFile(f); err == nil && bytes.Equal(current, content) {
+		return nil
+	}
+
+	if err := os.MkdirAll(pluginSpecDir, 0755); err != nil {
+		return err
+	}
+	logrus.Infof("Writing Docker plugin spec %s: %s", f, strings.TrimSpace(string(content)))
+	if err := ioutil.WriteFile(f+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(f+".tmp", f)
+}
+
+// removeSpecFile removes the discovery file of a plugin, as long as it's
+// still the one binexec wrote
+func removeSpecFile(name string, p plugin) {
+	content, err := p.specContent(name)
+	if err != nil {
+		return
+	}
+	f := p.specFile(name)
+	if current, err := ioutil.ReadFile(f); err != nil || !bytes.Equal(current, content) {
+		return
+	}
+	logrus.Infof("Removing Docker plugin spec %s", f)
+	if err := os.Remove(f); err != nil {
+		logrus.Errorf("Failed to remove %s: %v", f, err)
+	}
+}
+
+// pluginProxy forwards the connections to a socket on the host to the
+// plugin socket in the driver container
+type pluginProxy struct {
+	l    net.Listener
+	path string
+}
+
+func (w *Watcher) startProxy(name, path string) error {
+	if proxy, ok := w.proxies[name]; ok && proxy.path == path {
+		return nil
+	}
+	w.stopProxy(name)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	proxy := &pluginProxy{l: l, path: path}
+	w.proxies[name] = proxy
+	logrus.Infof("Proxying Docker plugin %s on %s", name, path)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go w.forward(name, conn)
+		}
+	}()
+	return nil
+}
+
+func (w *Watcher) stopProxy(name string) {
+	proxy, ok := w.proxies[name]
+	if !ok {
+		return
+	}
+	delete(w.proxies, name)
+	proxy.l.Close()
+	os.Remove(proxy.path)
+}
+
+// forward connects to the plugin socket through the root of the driver
+// container process, so that the socket doesn't need to be exposed
+func (w *Watcher) forward(name string, conn net.Conn) {
+	defer conn.Close()
+
+	w.Lock()
+	p := w.plugins[name]
+	w.Unlock()
+	if p.PID == 0 {
+		logrus.Errorf("Docker plugin %s: driver container %s is not running", name, p.ContainerID)
+		return
+	}
+
+	target, err := net.Dial("unix", filepath.Join(procDir, fmt.Sprint(p.PID), "root", p.Socket))
+	if err != nil {
+		logrus.Errorf("Docker plugin %s: %v", name, err)
+		return
+	}
+	defer target.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,92 @@
+package binexec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+)
+
+func TestGetPlugin(t *testing.T) {
+	name, p, ok := getPlugin(map[string]string{pluginLabel: "rancher-nfs"}, "abc")
+	if !ok || name != "rancher-nfs" || p.Socket != "/run/docker/plugins/rancher-nfs.sock" || p.ContainerID != "abc" {
+		t.Errorf("unexpected plugin %s %v %v", name, p, ok)
+	}
+
+	_, p, _ = getPlugin(map[string]string{pluginLabel: "rancher-nfs", pluginSocketLabel: "/var/run/nfs.sock"}, "abc")
+	if p.Socket != "/var/run/nfs.sock" {
+		t.Errorf("expected the socket of the label, got %s", p.Socket)
+	}
+
+	for _, name := range []string{"", "../nfs", ".nfs"} {
+		if _, _, ok := getPlugin(map[string]string{pluginLabel: name}, "abc"); ok {
+			t.Errorf("expected no plugin for %q", name)
+		}
+	}
+}
+
+func TestHostSocketPath(t *testing.T) {
+	mounts := []types.MountPoint{
+		{Type: "bind", Source: "/run/docker/plugins", Destination: "/run/docker/plugins"},
+		{Type: "bind", Source: "/var/lib/nfs", Destination: "/run/docker/plugins/nfs"},
+		{Type: "volume", Source: "/var/lib/docker/volumes/x", Destination: "/data"},
+	}
+
+	tests := []struct {
+		socket string
+		path   string
+		ok     bool
+	}{
+		{"/run/docker/plugins/ebs.sock", "/run/docker/plugins/ebs.sock", true},
+		{"/run/docker/plugins/nfs/nfs.sock", "/var/lib/nfs/nfs.sock", true},
+		{"/run/docker/pluginsx.sock", "", false},
+		{"/data/plugin.sock", "", false},
+	}
+	for _, test := range tests {
+		if path, ok := hostSocketPath(mounts, test.socket); path != test.path || ok != test.ok {
+			t.Errorf("%s: expected %s %v, got %s %v", test.socket, test.path, test.ok, path, ok)
+		}
+	}
+}
+
+func TestSpecFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugins")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	old := pluginSpecDir
+	pluginSpecDir = dir
+	defer func() { pluginSpecDir = old }()
+
+	p := plugin{Addr: "unix:///run/docker/plugins/ebs.sock"}
+	if err := writeSpecFile("ebs", p); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "ebs.spec")); err != nil || string(content) != p.Addr+"\n" {
+		t.Errorf("unexpected spec %q, %v", content, err)
+	}
+
+	j := plugin{Addr: "unix:///run/rancher/docker-plugins/nfs.sock", Format: pluginFormatJSON}
+	if err := writeSpecFile("nfs", j); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{"Addr":"unix:///run/rancher/docker-plugins/nfs.sock","Name":"nfs"}`
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "nfs.json")); err != nil || string(content) != expected {
+		t.Errorf("unexpected spec %q, %v", content, err)
+	}
+
+	// A spec file changed by someone else is kept
+	ioutil.WriteFile(filepath.Join(dir, "ebs.spec"), []byte("tcp://localhost:8080\n"), 0644)
+	removeSpecFile("ebs", p)
+	removeSpecFile("nfs", j)
+
+	if _, err := os.Stat(filepath.Join(dir, "ebs.spec")); err != nil {
+		t.Errorf("expected the changed spec to be kept, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nfs.json")); !os.IsNotExist(err) {
+		t.Errorf("expected the spec to be removed, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package binexec
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -12,33 +13,60 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/rancher/cniglue"
 	"github.com/rancher/go-rancher-metadata/metadata"
 )
 
 var (
-	reapplyEvery = 5 * time.Minute
-	binDir       = glue.CniPath[0]
+	reapplyEvery        = 5 * time.Minute
+	healthCheckInterval = 30 * time.Second
+	binDir              = glue.CniPath[0]
 )
 
-func Watch(c metadata.Client, dc *client.Client) *Watcher {
+// Watch sets up wrappers entering the driver containers for the binaries
+// they provide. If kubeletBinDir is set, the wrappers are also written
+// there for kubelet to use. The wrappers are tracked in a manifest, the
+// ones of removed drivers are deleted and the PIDs they enter are checked
+// periodically.
+func Watch(c metadata.Client, dc *client.Client, kubeletBinDir string) *Watcher {
+	m, err := loadManifest()
+	if err != nil {
+		logrus.Errorf("Failed to load the binexec manifest, starting from scratch: %v", err)
+	}
+	plugins, err := loadPluginManifest()
+	if err != nil {
+		logrus.Errorf("Failed to load the binexec plugin manifest, starting from scratch: %v", err)
+	}
+
 	w := &Watcher{
-		c:       c,
-		dc:      dc,
-		applied: map[string]string{},
+		c:              c,
+		dc:             dc,
+		kubeletBinDir:  kubeletBinDir,
+		applied:        map[string]wrapper{},
+		appliedPlugins: map[string]plugin{},
+		manifest:       m,
+		plugins:        plugins,
+		proxies:        map[string]*pluginProxy{},
 	}
 	w.onChange("")
 	go c.OnChange(5, w.onChangeNoError)
+	go w.checkPeriodically()
 	return w
 }
 
 type Watcher struct {
 	sync.Mutex
-	c           metadata.Client
-	dc          *client.Client
-	applied     map[string]string
-	lastApplied time.Time
+	c              metadata.Client
+	dc             *client.Client
+	kubeletBinDir  string
+	applied        map[string]wrapper
+	appliedPlugins map[string]plugin
+	manifest       manifest
+	plugins        map[string]plugin
+	proxies        map[string]*pluginProxy
+	lastApplied    time.Time
 }
 
 func (w *Watcher) onChangeNoError(version string) {
@@ -47,31 +75,52 @@ func (w *Watcher) onChangeNoError(version string) {
 	}
 }
 
+// Handle updates the wrappers of a driver container when it starts or
+// dies, so that they never enter a stale PID
 func (w *Watcher) Handle(event *docker.APIEvents) error {
 	w.Lock()
 
 	changed := false
 	for _, v := range w.applied {
-		if v == event.ID {
-			changed = true
-			break
-		}
+		changed = changed || v.ContainerID == event.ID
+	}
+	for _, v := range w.appliedPlugins {
+		changed = changed || v.ContainerID == event.ID
+	}
+
+	if !changed {
+		w.Unlock()
+		return nil
+	}
+
+	if event.Status == "die" {
+		defer w.Unlock()
+		logrus.Infof("Driver container %s died, removing its binaries", event.ID)
+		return w.healthCheck()
 	}
 
 	w.lastApplied = time.Time{}
 	w.Unlock()
+	return w.onChange("")
+}
 
-	if changed {
-		return w.onChange("")
+func (w *Watcher) checkPeriodically() {
+	for {
+		time.Sleep(healthCheckInterval)
+		w.Lock()
+		if err := w.healthCheck(); err != nil {
+			logrus.Errorf("Failed to check binaries: %v", err)
+		}
+		w.Unlock()
 	}
-	return nil
 }
 
 func (w *Watcher) onChange(version string) error {
 	w.Lock()
 	defer w.Unlock()
 
-	binaries := map[string]string{}
+	binaries := map[string]wrapper{}
+	plugins := map[string]plugin{}
 	driverServices := map[string]metadata.Service{}
 
 	services, err := w.c.GetServices()
@@ -92,13 +141,19 @@ func (w *Watcher) onChange(version string) error {
 		driverServices[service.StackUUID+"/"+service.Name] = service
 	}
 
+	// Sidecars are part of the driver of their primary service
+	kinds := map[string]string{}
+	for key, service := range driverServices {
+		kinds[key] = service.Kind
+	}
 	for _, service := range services {
-		if _, ok := driverServices[service.StackUUID+"/"+service.PrimaryServiceName]; ok {
+		if primary, ok := driverServices[service.StackUUID+"/"+service.PrimaryServiceName]; ok {
 			driverServices[service.StackUUID+"/"+service.Name] = service
+			kinds[service.StackUUID+"/"+service.Name] = primary.Kind
 		}
 	}
 
-	for _, service := range driverServices {
+	for key, service := range driverServices {
 		for _, container := range service.Containers {
 			logrus.WithFields(logrus.Fields{
 				"serviceKind":         service.Kind,
@@ -108,77 +163,254 @@ func (w *Watcher) onChange(version string) error {
 				"containerHostUUID":   container.HostUUID,
 				"driverLabel":         hasDriverLabel(container),
 			}).Debugf("Checking for driver binary")
+			if container.ExternalId != "" && container.HostUUID == host.UUID && kinds[key] == "storageDriverService" {
+				if name, p, ok := getPlugin(container.Labels, container.ExternalId); ok {
+					plugins[name] = p
+				}
+			}
 			if container.ExternalId != "" && container.HostUUID == host.UUID && hasDriverLabel(container) {
 				binName := getBinaryName(container)
 				if binName != "" {
-					binaries[binName] = container.ExternalId
+					binaries[binName] = wrapper{
+						ContainerID: container.ExternalId,
+						Mode:        container.Labels[binaryModeLabel],
+						Source:      container.Labels[binaryPathLabel],
+						Checksum:    container.Labels[binaryChecksumLabel],
+						Network:     kinds[key] == "networkDriverService",
+					}
 				}
 			}
 		}
 	}
 
-	if time.Now().Sub(w.lastApplied) > reapplyEvery || !reflect.DeepEqual(binaries, w.applied) {
-		return w.apply(host, binaries)
+	if time.Now().Sub(w.lastApplied) > reapplyEvery || !reflect.DeepEqual(binaries, w.applied) ||
+		!reflect.DeepEqual(plugins, w.appliedPlugins) {
+		return w.apply(host, binaries, plugins)
 	}
 
 	return nil
 }
 
-func (w *Watcher) apply(host metadata.Host, binaries map[string]string) error {
+func (w *Watcher) apply(host metadata.Host, binaries map[string]wrapper, plugins map[string]plugin) error {
 	if !reflect.DeepEqual(binaries, w.applied) {
 		logrus.Infof("Setting up binaries for: %v", binaries)
 	}
+	if !reflect.DeepEqual(plugins, w.appliedPlugins) {
+		logrus.Infof("Setting up Docker plugins for: %v", plugins)
+	}
 
-	script := `#!/bin/sh
-exec /usr/bin/nsenter -m -u -i -n -p -t %d -- $0 "$@"
-`
+	wanted := manifest{}
+	for name, spec := range binaries {
+		wanted[name] = spec
+	}
+	wantedPlugins := map[string]plugin{}
+	for name, spec := range plugins {
+		wantedPlugins[name] = spec
+	}
 
+	err := w.sync(wanted)
+	if pluginsErr := w.syncPlugins(wantedPlugins); pluginsErr != nil {
+		err = pluginsErr
+	}
+	if err != nil {
+		return err
+	}
+
+	w.applied = binaries
+	w.appliedPlugins = plugins
+	w.lastApplied = time.Now()
+	return nil
+}
+
+// healthCheck makes sure the wrappers and plugin proxies enter the current
+// PID of their driver container. Must be called with the lock held.
+func (w *Watcher) healthCheck() error {
+	wanted := manifest{}
+	for name, wr := range w.manifest {
+		wanted[name] = wr.spec()
+	}
+	wantedPlugins := map[string]plugin{}
+	for name, p := range w.plugins {
+		wantedPlugins[name] = p.spec()
+	}
+
+	err := w.sync(wanted)
+	if pluginsErr := w.syncPlugins(wantedPlugins); pluginsErr != nil {
+		err = pluginsErr
+	}
+	return err
+}
+
+// sync sets up the wanted binaries. Wrappers are written for the PID
+// their driver container is running with, those whose driver isn't
+// running are removed until it starts again. Extracted binaries are kept
+// while the driver is down and extracted again when it restarts. The
+// binaries not wanted anymore are removed for good.
+func (w *Watcher) sync(wanted manifest) error {
 	os.MkdirAll(binDir, 0700)
+	if w.kubeletBinDir != "" {
+		os.MkdirAll(w.kubeletBinDir, 0755)
+	}
 
 	var lastErr error
-	for name, target := range binaries {
-		container, err := w.dc.ContainerInspect(context.Background(), target)
+	for name, wr := range wanted {
+		current, known := w.manifest[name]
+		state, err := w.driverState(wr.ContainerID)
 		if err != nil {
+			// Unknown state, leave the binary as it is
 			lastErr = err
-			break
+			if known {
+				wanted[name] = current
+			}
+			continue
 		}
 
-		if container.State == nil || container.State.Pid == 0 {
-			lastErr = fmt.Errorf("container is not running")
-			break
+		wr.Dirs = w.dirs()
+		if wr.Mode == modeExtract {
+			wr, err = w.syncExtracted(name, wr, current, state)
+			if err != nil {
+				logrus.Errorf("Failed to extract %s from driver container %s: %v", name, wr.ContainerID, err)
+				lastErr = err
+			}
+			wanted[name] = wr
+			continue
 		}
 
-		ptmp := filepath.Join(binDir, name+".tmp")
-		p := filepath.Join(binDir, name)
-		content := []byte(fmt.Sprintf(script, container.State.Pid))
-		logrus.Debugf("Writing %s:\n%s", p, content)
-		if err := ioutil.WriteFile(ptmp, content, 0700); err != nil {
-			lastErr = err
-			break
+		wr.PID = state.Pid
+		if known && current.PID != wr.PID {
+			logrus.Infof("Driver container %s of %s changed from PID %d to %d", wr.ContainerID, name, current.PID, wr.PID)
 		}
 
-		fileInfo, err := os.Stat(p)
-		if err == nil && fileInfo.IsDir() {
-			logrus.Infof("%s is a dir, remove it", p)
-			if err = os.Remove(p); err != nil {
-				lastErr = err
-				break
+		if wr.PID == 0 {
+			removeWrapper(name, append(current.Dirs, wr.Dirs...))
+		} else {
+			for _, dir := range wr.Dirs {
+				if err := writeWrapper(dir, name, wrapperScript(wr.PID, name)); err != nil {
+					lastErr = err
+				}
 			}
+			// Directories not used anymore
+			removeWrapper(name, missingDirs(current.Dirs, wr.Dirs))
 		}
+		wanted[name] = wr
+	}
 
-		if err := os.Rename(ptmp, p); err != nil {
-			lastErr = err
+	for name, wr := range w.manifest {
+		if _, ok := wanted[name]; !ok {
+			logrus.Infof("Removing binary %s of driver container %s which is gone", name, wr.ContainerID)
+			removeBinary(name, wr)
 		}
 	}
 
-	if lastErr == nil {
-		w.applied = binaries
-		w.lastApplied = time.Now()
+	w.manifest = wanted
+	if err := w.manifest.save(); err != nil {
+		lastErr = err
 	}
-
 	return lastErr
 }
 
+// driverState returns the state of a driver container, a zero state if
+// it isn't running or doesn't exist anymore
+func (w *Watcher) driverState(id string) (types.ContainerState, error) {
+	container, err := w.dc.ContainerInspect(context.Background(), id)
+	if client.IsErrContainerNotFound(err) {
+		return types.ContainerState{}, nil
+	} else if err != nil {
+		return types.ContainerState{}, err
+	}
+
+	if container.State == nil || !container.State.Running {
+		return types.ContainerState{}, nil
+	}
+	return *container.State, nil
+}
+
+func (w *Watcher) dirs() []string {
+	if w.kubeletBinDir != "" && w.kubeletBinDir != binDir {
+		return []string{binDir, w.kubeletBinDir}
+	}
+	return []string{binDir}
+}
+
+// wrapperScript enters the driver container to run the binary. It's named
+// explicitly, $0 is the path of the wrapper which depends on who runs it.
+func wrapperScript(pid int, name string) []byte {
+	script := `#!/bin/sh
+exec /usr/bin/nsenter -m -u -i -n -p -t %d -- %s "$@"
+`
+	return []byte(fmt.Sprintf(script, pid, filepath.Join(binDir, name)))
+}
+
+func missingDirs(dirs, current []string) []string {
+	ret := []string{}
+	for _, dir := range dirs {
+		found := false
+		for _, c := range current {
+			found = found || c == dir
+		}
+		if !found {
+			ret = append(ret, dir)
+		}
+	}
+	return ret
+}
+
+// removeBinary removes a binary owned by binexec, along with the previous
+// version of an extracted one
+func removeBinary(name string, wr wrapper) {
+	removeWrapper(name, wr.Dirs)
+	if wr.Mode != modeExtract || wr.SHA256 == "" {
+		return
+	}
+
+	for _, dir := range wr.Dirs {
+		p := filepath.Join(dir, name)
+		if sum, err := fileSHA256(p); err != nil || sum != wr.SHA256 {
+			continue
+		}
+		logrus.Infof("Removing %s", p)
+		if err := os.Remove(p); err != nil {
+			logrus.Errorf("Failed to remove %s: %v", p, err)
+		}
+		os.Remove(p + prevSuffix)
+	}
+}
+
+func removeWrapper(name string, dirs []string) {
+	for _, dir := range dirs {
+		p := filepath.Join(dir, name)
+		if !isWrapper(p) {
+			continue
+		}
+		logrus.Infof("Removing %s", p)
+		if err := os.Remove(p); err != nil {
+			logrus.Errorf("Failed to remove %s: %v", p, err)
+		}
+	}
+}
+
+func writeWrapper(dir, name string, content []byte) error {
+	ptmp := filepath.Join(dir, name+".tmp")
+	p := filepath.Join(dir, name)
+	if current, err := ioutil.ReadFile(p); err == nil && bytes.Equal(current, content) {
+		return nil
+	}
+	logrus.Debugf("Writing %s:\n%s", p, content)
+	if err := ioutil.WriteFile(ptmp, content, 0700); err != nil {
+		return err
+	}
+
+	fileInfo, err := os.Stat(p)
+	if err == nil && fileInfo.IsDir() {
+		logrus.Infof("%s is a dir, remove it", p)
+		if err = os.Remove(p); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(ptmp, p)
+}
+
 func getBinaryName(container metadata.Container) string {
 	return container.Labels["io.rancher.network.cni.binary"]
 }
@@ -0,0 +1,66 @@
+package binexec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func setupBinDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "binexec")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	old := binDir
+	binDir = dir
+	return dir, func() {
+		binDir = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	_, cleanup := setupBinDir(t)
+	defer cleanup()
+
+	if m, err := loadManifest(); err != nil || len(m) != 0 {
+		t.Fatalf("expected an empty manifest, got %v, %v", m, err)
+	}
+
+	m := manifest{"rancher-bridge": {ContainerID: "abc", PID: 42, Dirs: []string{binDir}}}
+	if err := m.save(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	loaded, err := loadManifest()
+	if err != nil || !reflect.DeepEqual(loaded, m) {
+		t.Errorf("expected %v, got %v, %v", m, loaded, err)
+	}
+}
+
+func TestRemoveWrapper(t *testing.T) {
+	dir, cleanup := setupBinDir(t)
+	defer cleanup()
+
+	if err := writeWrapper(dir, "rancher-bridge", wrapperScript(42, "rancher-bridge")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "bridge"), []byte("\x7fELF"), 0700)
+
+	removeWrapper("rancher-bridge", []string{dir})
+	removeWrapper("bridge", []string{dir})
+
+	if _, err := os.Stat(filepath.Join(dir, "rancher-bridge")); !os.IsNotExist(err) {
+		t.Errorf("expected the wrapper to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bridge")); err != nil {
+		t.Errorf("expected a real binary to be kept, got %v", err)
+	}
+}
+
+func TestMissingDirs(t *testing.T) {
+	if dirs := missingDirs([]string{"/a", "/b"}, []string{"/a"}); !reflect.DeepEqual(dirs, []string{"/b"}) {
+		t.Errorf("unexpected dirs %v", dirs)
+	}
+}
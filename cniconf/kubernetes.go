@@ -0,0 +1,97 @@
+package cniconf
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+var (
+	// kubernetesConfRegexp matches the conflists written for kubelet, at
+	// any priority
+	kubernetesConfRegexp = regexp.MustCompile(`^[0-9]+-rancher\.conflist$`)
+)
+
+func (w *Watcher) kubernetesConfName() string {
+	return fmt.Sprintf("%02d-rancher.conflist", w.opts.KubernetesPriority)
+}
+
+// applyKubernetes writes the config of the default network as a conflist
+// in the kubelet config directory, or removes it when there is no default
+// network. An invalid config leaves the previous one in place. The
+// conflists written with other priorities are removed, other files are
+// never touched.
+func (w *Watcher) applyKubernetes(network *metadata.Network, host metadata.Host) error {
+	dir := w.opts.KubernetesConfDir
+	name := ""
+
+	if network != nil {
+		cniConf, err := networkConfig(*network, host)
+		if err != nil {
+			return errors.Wrapf(err, "invalid cni conf for network %s, keeping the previous one", network.Name)
+		}
+
+		content, err := marshal(confList(network.Name, cniConf))
+		if err != nil {
+			return err
+		}
+
+		name = w.kubernetesConfName()
+		if err := writeFileAtomic(filepath.Join(dir, name), content); err != nil {
+			return err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, entry := range entries {
+		if entry.Name() == name || !kubernetesConfRegexp.MatchString(entry.Name()) {
+			continue
+		}
+		p := filepath.Join(dir, entry.Name())
+		logrus.Infof("Removing kubernetes cni conf %s", p)
+		if err := os.Remove(p); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// writeFileAtomic replaces p with content through a rename, so that
+// kubelet never reads a partial file. Nothing is done if p already has
+// that content.
+func writeFileAtomic(p string, content []byte) error {
+	if current, err := ioutil.ReadFile(p); err == nil && bytes.Equal(current, content) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// The .tmp extension keeps it out of the config files kubelet loads
+	tmp := filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".tmp")
+	logrus.Debugf("Writing %s: %s", p, content)
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	logrus.Infof("Wrote kubernetes cni conf %s", p)
+	return nil
+}
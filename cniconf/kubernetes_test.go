@@ -0,0 +1,58 @@
+package cniconf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestApplyKubernetes(t *testing.T) {
+	defer setupCNIPath(t, "rancher-bridge", "portmap")()
+
+	dir, err := ioutil.TempDir("", "net.d")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "05-other.conf"), []byte("{}"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "20-rancher.conflist"), []byte("{}"), 0600)
+
+	w := &Watcher{opts: Options{KubernetesConfDir: dir, KubernetesPriority: 1}}
+	network := testNetwork(t, "ipsec", `{"10-rancher.conf": {"cniVersion": "0.3.1", "type": "rancher-bridge"}, "20-portmap.conf": {"type": "portmap"}}`)
+	if err := w.applyKubernetes(&network, metadata.Host{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "01-rancher.conflist"))
+	if err != nil {
+		t.Fatalf("reading conflist: %v", err)
+	}
+	list := cniConfListJSON{}
+	if err := json.Unmarshal(content, &list); err != nil || list.Name != "ipsec" || list.CNIVersion != "0.3.1" || len(list.Plugins) != 2 {
+		t.Errorf("unexpected conflist %s, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "20-rancher.conflist")); !os.IsNotExist(err) {
+		t.Errorf("expected the conflist of another priority to be removed")
+	}
+
+	// An invalid config keeps the previous one
+	invalid := testNetwork(t, "ipsec", `{"10-rancher.conf": {"type": "rancher-brdige"}}`)
+	if err := w.applyKubernetes(&invalid, metadata.Host{}); err == nil {
+		t.Errorf("expected an error for an invalid config")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "01-rancher.conflist")); err != nil {
+		t.Errorf("expected the previous conflist to be kept: %v", err)
+	}
+
+	if err := w.applyKubernetes(nil, metadata.Host{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "05-other.conf" {
+		t.Errorf("expected only the unrelated config to be left, got %v", entries)
+	}
+}
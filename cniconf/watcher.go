@@ -8,9 +8,12 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
 	"github.com/rancher/cniglue"
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/plugin-manager/utils"
@@ -18,36 +21,120 @@ import (
 
 var (
 	reapplyEvery = 5 * time.Minute
-	cniDir       = "/etc/cni/%s.d"
+	// retryInvalidEvery is how often invalid configs are checked again,
+	// e.g. a driver binary may show up after its network was rejected
+	retryInvalidEvery = 30 * time.Second
+	cniDir            = "/etc/cni/%s.d"
+	managedName       = "managed"
+	cniPath           = glue.CniPath
+	// defaultConfListVersion is used for conflists when the first plugin
+	// doesn't have a cniVersion
+	defaultConfListVersion = "0.3.1"
 )
 
 func init() {
 	glue.CniDir = cniDir
 }
 
-// Watch monitors metadata and generates CNI config
-func Watch(c metadata.Client) error {
-	w := &watcher{
+// Options customizes the CNI config rendered by the watcher
+type Options struct {
+	// ConfList renders a single .conflist per network instead of a file
+	// per key of the cniConfig
+	ConfList bool
+	// KubernetesConfDir, if set, gets the config of the default network
+	// as a conflist usable by kubelet
+	KubernetesConfDir string
+	// KubernetesPriority prefixes the conflist in KubernetesConfDir,
+	// kubelet uses the first config in lexical order
+	KubernetesPriority int
+}
+
+// Watch monitors metadata and generates CNI config. The config of every
+// network is rendered in a new directory and swapped in atomically by
+// pointing the network's directory symlink to it. Invalid configs are
+// reported and not written, the last good one stays in place.
+func Watch(c metadata.Client, opts Options) (*Watcher, error) {
+	w := &Watcher{
 		c:       c,
+		opts:    opts,
 		applied: map[string]metadata.Network{},
+		invalid: map[string]InvalidNetwork{},
 	}
 	go c.OnChange(5, w.onChangeNoError)
-	return nil
+	go w.retryInvalid()
+	return w, nil
 }
 
-type watcher struct {
+// Watcher renders the CNI config of the networks of the environment
+type Watcher struct {
+	sync.Mutex
+	// applying serializes onChange, the embedded mutex only guards invalid
+	applying    sync.Mutex
 	c           metadata.Client
+	opts        Options
 	applied     map[string]metadata.Network
+	invalid     map[string]InvalidNetwork
 	lastApplied time.Time
 }
 
-func (w *watcher) onChangeNoError(version string) {
+// InvalidNetwork reports a network whose CNI config failed validation
+type InvalidNetwork struct {
+	Network string    `json:"network"`
+	Error   string    `json:"error"`
+	Time    time.Time `json:"time"`
+}
+
+// Status is the status of the CNI config as reported by the status API
+type Status struct {
+	Invalid []InvalidNetwork `json:"invalid"`
+}
+
+// Status returns the networks whose CNI config is invalid
+func (w *Watcher) Status() Status {
+	w.Lock()
+	defer w.Unlock()
+	ret := Status{Invalid: []InvalidNetwork{}}
+	for _, invalid := range w.invalid {
+		ret.Invalid = append(ret.Invalid, invalid)
+	}
+	return ret
+}
+
+func (w *Watcher) setInvalid(name string, err error) {
+	w.Lock()
+	defer w.Unlock()
+	if err == nil {
+		delete(w.invalid, name)
+		return
+	}
+	w.invalid[name] = InvalidNetwork{
+		Network: name,
+		Error:   err.Error(),
+		Time:    time.Now(),
+	}
+}
+
+func (w *Watcher) onChangeNoError(version string) {
+	w.applying.Lock()
+	defer w.applying.Unlock()
 	if err := w.onChange(version); err != nil {
 		logrus.Errorf("Failed to apply cni conf: %v", err)
 	}
 }
 
-func (w *watcher) onChange(version string) error {
+// retryInvalid applies the config again while some networks are invalid,
+// metadata only notifies of new versions
+func (w *Watcher) retryInvalid() {
+	for {
+		time.Sleep(retryInvalidEvery)
+		if len(w.Status().Invalid) > 0 {
+			logrus.Debugf("Retrying invalid cni conf")
+			w.onChangeNoError("")
+		}
+	}
+}
+
+func (w *Watcher) onChange(version string) error {
 	networks, err := w.c.GetNetworks()
 	if err != nil {
 		return err
@@ -60,6 +147,8 @@ func (w *watcher) onChange(version string) error {
 
 	forceApply := time.Now().Sub(w.lastApplied) > reapplyEvery
 
+	wanted := map[string]bool{}
+	var defaultNetwork *metadata.Network
 	for _, network := range networks {
 		if network.EnvironmentUUID != host.EnvironmentUUID {
 			logrus.Debugf("network: %v is not local to this environment", network.UUID)
@@ -70,6 +159,12 @@ func (w *watcher) onChange(version string) error {
 			continue
 		}
 
+		wanted[network.Name] = true
+		if network.Default {
+			n := network
+			defaultNetwork = &n
+		}
+
 		if forceApply || !reflect.DeepEqual(w.applied[network.Name], network) {
 			if err := w.apply(network, host); err != nil {
 				logrus.Errorf("Failed to apply cni conf: %v", err)
@@ -77,54 +172,322 @@ func (w *watcher) onChange(version string) error {
 		}
 	}
 
-	return nil
+	if err := w.prune(wanted); err != nil {
+		logrus.Errorf("Failed to prune cni conf: %v", err)
+	}
+
+	if w.opts.KubernetesConfDir != "" {
+		if err := w.applyKubernetes(defaultNetwork, host); err != nil {
+			logrus.Errorf("Failed to apply kubernetes cni conf: %v", err)
+		}
+	}
+
+	defaultName := ""
+	if defaultNetwork != nil {
+		defaultName = defaultNetwork.Name
+	}
+	return setManagedLink(defaultName)
 }
 
-func (w *watcher) apply(network metadata.Network, host metadata.Host) error {
-	cniConf, _ := network.Metadata["cniConfig"].(map[string]interface{})
-	confDir := fmt.Sprintf(cniDir, network.Name)
-	if err := os.MkdirAll(confDir, 0700); err != nil {
+func (w *Watcher) apply(network metadata.Network, host metadata.Host) error {
+	files, err := w.render(network, host)
+	w.setInvalid(network.Name, err)
+	if err != nil {
+		return errors.Wrapf(err, "invalid cni conf for network %s, keeping the previous one", network.Name)
+	}
+
+	if err := swapConfDir(network.Name, files); err != nil {
 		return err
 	}
 
-	var lastErr error
-	for file, config := range cniConf {
-		config = utils.UpdateCNIConfigByKeywords(config, host)
-		p := filepath.Join(confDir, file)
-		content, err := json.Marshal(config)
+	w.applied[network.Name] = network
+	w.lastApplied = time.Now()
+	return nil
+}
+
+// networkConfig returns the validated cniConfig of a network for the host
+func networkConfig(network metadata.Network, host metadata.Host) (map[string]interface{}, error) {
+	updated, err := utils.NetworkCNIConfig(network, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(updated) == 0 {
+		return nil, fmt.Errorf("no cni config")
+	}
+	for file, config := range updated {
+		if err := utils.ValidateCNIConfig(file, config, cniPath); err != nil {
+			return nil, err
+		}
+	}
+	return updated, nil
+}
+
+// render returns the content of the config files of a network by name
+func (w *Watcher) render(network metadata.Network, host metadata.Host) (map[string][]byte, error) {
+	updated, err := networkConfig(network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.opts.ConfList {
+		content, err := marshal(confList(network.Name, updated))
 		if err != nil {
-			lastErr = err
-			continue
+			return nil, err
 		}
+		return map[string][]byte{network.Name + ".conflist": content}, nil
+	}
 
-		out := &bytes.Buffer{}
-		if err := json.Indent(out, content, "", "  "); err != nil {
-			lastErr = err
+	files := map[string][]byte{}
+	for file, config := range updated {
+		if file != filepath.Base(file) || strings.HasPrefix(file, ".") {
+			return nil, fmt.Errorf("invalid cni config file name %q", file)
+		}
+		content, err := marshal(config)
+		if err != nil {
+			return nil, err
+		}
+		files[file] = content
+	}
+	return files, nil
+}
+
+// confList builds a CNI spec conflist chaining the plugins of all the
+// config files, in file name order
+func confList(name string, cniConf map[string]interface{}) map[string]interface{} {
+	plugins := utils.CNIPluginConfigs(cniConf)
+
+	version := defaultConfListVersion
+	if len(plugins) > 0 {
+		if v, ok := plugins[0]["cniVersion"].(string); ok && v != "" {
+			version = v
+		}
+	}
+
+	list := []interface{}{}
+	for _, plugin := range plugins {
+		p := map[string]interface{}{}
+		for k, v := range plugin {
+			if k != "name" && k != "cniVersion" {
+				p[k] = v
+			}
+		}
+		list = append(list, p)
+	}
+
+	return map[string]interface{}{
+		"name":       name,
+		"cniVersion": version,
+		"plugins":    list,
+	}
+}
+
+func marshal(config interface{}) ([]byte, error) {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, content, "", "  "); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func cniRoot() string {
+	return filepath.Dir(fmt.Sprintf(cniDir, "x"))
+}
+
+// versionDirPrefix is the prefix of the directories holding the rendered
+// versions of the config of a network
+func versionDirPrefix(name string) string {
+	return "." + filepath.Base(fmt.Sprintf(cniDir, name)) + "-"
+}
+
+// swapConfDir writes the files in a new directory and atomically points
+// the config directory symlink of the network to it. Nothing is done if
+// the current directory already holds exactly those files.
+func swapConfDir(name string, files map[string][]byte) error {
+	confDir := fmt.Sprintf(cniDir, name)
+	if sameFiles(confDir, files) {
+		return nil
+	}
+
+	root := cniRoot()
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return err
+	}
+
+	newDir, err := ioutil.TempDir(root, versionDirPrefix(name))
+	if err != nil {
+		return err
+	}
+
+	for file, content := range files {
+		p := filepath.Join(newDir, file)
+		logrus.Debugf("Writing %s: %s", p, content)
+		if err := ioutil.WriteFile(p, content, 0600); err != nil {
+			os.RemoveAll(newDir)
+			return err
+		}
+	}
+
+	oldTarget, _ := os.Readlink(confDir)
+	if err := replaceWithSymlink(filepath.Base(newDir), confDir); err != nil {
+		os.RemoveAll(newDir)
+		return err
+	}
+	logrus.Infof("Switched cni conf of %s to %s", name, newDir)
+
+	if oldTarget != "" && strings.HasPrefix(oldTarget, versionDirPrefix(name)) {
+		os.RemoveAll(filepath.Join(root, oldTarget))
+	}
+	return nil
+}
+
+// replaceWithSymlink atomically makes link a symlink to target. A
+// directory left by older versions is removed first.
+func replaceWithSymlink(target, link string) error {
+	if fi, err := os.Lstat(link); err == nil && fi.IsDir() {
+		if err := os.RemoveAll(link); err != nil {
+			return err
+		}
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d", link, time.Now().UnixNano())
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func sameFiles(dir string, files map[string][]byte) bool {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != len(files) {
+		return false
+	}
+	for _, entry := range entries {
+		expected, ok := files[entry.Name()]
+		if !ok {
+			return false
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil || !bytes.Equal(content, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// prune removes the config of the networks that are gone. Only the
+// directories rendered by the Watcher are touched, those are symlinks to
+// a version directory, or networks applied since the start.
+func (w *Watcher) prune(wanted map[string]bool) error {
+	root := cniRoot()
+	entries, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	for name := range w.applied {
+		names[name] = true
+	}
+	for _, entry := range entries {
+		name, ok := networkName(entry.Name())
+		if !ok || name == managedName {
 			continue
 		}
+		if target, err := os.Readlink(filepath.Join(root, entry.Name())); err == nil && strings.HasPrefix(target, versionDirPrefix(name)) {
+			names[name] = true
+		}
+	}
 
-		logrus.Debugf("Writing %s: %s", p, out)
-		if err := ioutil.WriteFile(p, out.Bytes(), 0600); err != nil {
+	w.Lock()
+	for name := range w.invalid {
+		if !wanted[name] {
+			delete(w.invalid, name)
+		}
+	}
+	w.Unlock()
+
+	var lastErr error
+	for name := range names {
+		if wanted[name] {
+			continue
+		}
+		if err := removeConfDir(name); err != nil {
 			lastErr = err
+			continue
 		}
+		delete(w.applied, name)
 	}
 
-	if network.Default {
-		managedDir := fmt.Sprintf(cniDir, "managed")
-		managedDirTest, err := os.Stat(managedDir)
-		configDirTest, err1 := os.Stat(confDir)
-		if !(err == nil && err1 == nil && os.SameFile(managedDirTest, configDirTest)) {
-			os.Remove(managedDir)
-			if err := os.Symlink(network.Name+".d", managedDir); err != nil {
-				lastErr = err
+	// Version directories left behind by an interrupted swap
+	for _, entry := range entries {
+		for name := range wanted {
+			prefix := versionDirPrefix(name)
+			if !strings.HasPrefix(entry.Name(), prefix) {
+				continue
+			}
+			if target, _ := os.Readlink(fmt.Sprintf(cniDir, name)); target != entry.Name() {
+				os.RemoveAll(filepath.Join(root, entry.Name()))
 			}
 		}
 	}
 
-	if lastErr == nil {
-		w.applied[network.Name] = network
-		w.lastApplied = time.Now()
+	return lastErr
+}
+
+// networkName returns the network of a config directory name
+func networkName(dir string) (string, bool) {
+	pattern := filepath.Base(cniDir)
+	i := strings.Index(pattern, "%s")
+	prefix, suffix := pattern[:i], pattern[i+2:]
+	if strings.HasPrefix(dir, ".") || !strings.HasPrefix(dir, prefix) || !strings.HasSuffix(dir, suffix) ||
+		len(dir) <= len(prefix)+len(suffix) {
+		return "", false
 	}
+	return dir[len(prefix) : len(dir)-len(suffix)], true
+}
 
-	return lastErr
+func removeConfDir(name string) error {
+	confDir := fmt.Sprintf(cniDir, name)
+	logrus.Infof("Removing cni conf of deleted network %s", name)
+
+	if target, err := os.Readlink(confDir); err == nil {
+		if err := os.Remove(confDir); err != nil {
+			return err
+		}
+		if strings.HasPrefix(target, versionDirPrefix(name)) {
+			return os.RemoveAll(filepath.Join(cniRoot(), target))
+		}
+		return nil
+	}
+	return os.RemoveAll(confDir)
+}
+
+// setManagedLink points the managed config directory to the one of the
+// default network, or removes it if there is no default network
+func setManagedLink(defaultNetwork string) error {
+	managedDir := fmt.Sprintf(cniDir, managedName)
+	if defaultNetwork == "" {
+		if target, err := os.Readlink(managedDir); err == nil {
+			logrus.Infof("Removing %s, it pointed to %s and there is no default network", managedDir, target)
+			return os.Remove(managedDir)
+		}
+		return nil
+	}
+
+	target := filepath.Base(fmt.Sprintf(cniDir, defaultNetwork))
+	if current, err := os.Readlink(managedDir); err == nil && current == target {
+		return nil
+	}
+	return replaceWithSymlink(target, managedDir)
 }
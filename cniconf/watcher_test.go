@@ -0,0 +1,248 @@
+package cniconf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+type cniConfListJSON struct {
+	Name       string                   `json:"name"`
+	CNIVersion string                   `json:"cniVersion"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+func setupCNIDir(t *testing.T) func() {
+	root, err := ioutil.TempDir("", "cniconf")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	old := cniDir
+	cniDir = filepath.Join(root, "%s.d")
+	return func() {
+		cniDir = old
+		os.RemoveAll(root)
+	}
+}
+
+func setupCNIPath(t *testing.T, binaries ...string) func() {
+	dir, err := ioutil.TempDir("", "cnibin")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	for _, binary := range binaries {
+		ioutil.WriteFile(filepath.Join(dir, binary), []byte("\x7fELF"), 0700)
+	}
+	old := cniPath
+	cniPath = []string{dir}
+	return func() {
+		cniPath = old
+		os.RemoveAll(dir)
+	}
+}
+
+func testNetwork(t *testing.T, name, cniConfig string) metadata.Network {
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(cniConfig), &conf); err != nil {
+		t.Fatalf("parsing cniConfig: %v", err)
+	}
+	return metadata.Network{
+		Name:     name,
+		Metadata: map[string]interface{}{"cniConfig": conf},
+	}
+}
+
+func readConfDir(t *testing.T, name string) map[string]string {
+	dir := filepath.Join(cniRoot(), name+".d")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("reading %s: %v", dir, err)
+	}
+	ret := map[string]string{}
+	for _, entry := range entries {
+		content, _ := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		ret[entry.Name()] = string(content)
+	}
+	return ret
+}
+
+func TestRenderConfList(t *testing.T) {
+	defer setupCNIPath(t, "rancher-bridge", "portmap")()
+
+	w := &Watcher{opts: Options{ConfList: true}}
+	network := testNetwork(t, "ipsec", `{
+  "10-rancher.conf": {"cniVersion": "0.3.0", "name": "rancher-cni-network", "type": "rancher-bridge", "bridge": "__host_label__: bridge"},
+  "20-portmap.conflist": {"plugins": [{"type": "portmap"}]}
+}`)
+	host := metadata.Host{Labels: map[string]string{"bridge": "docker0"}}
+
+	files, err := w.render(network, host)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, ok := files["ipsec.conflist"]
+	if !ok || len(files) != 1 {
+		t.Fatalf("expected a single ipsec.conflist, got %v", files)
+	}
+
+	list := cniConfListJSON{}
+	if err := json.Unmarshal(content, &list); err != nil {
+		t.Fatalf("parsing conflist: %v", err)
+	}
+	if list.Name != "ipsec" || list.CNIVersion != "0.3.0" || len(list.Plugins) != 2 {
+		t.Fatalf("unexpected conflist %s", content)
+	}
+	if list.Plugins[0]["type"] != "rancher-bridge" || list.Plugins[0]["bridge"] != "docker0" || list.Plugins[1]["type"] != "portmap" {
+		t.Errorf("unexpected plugins %v", list.Plugins)
+	}
+	if _, ok := list.Plugins[0]["name"]; ok {
+		t.Errorf("plugin names should be dropped: %v", list.Plugins[0])
+	}
+}
+
+func TestRenderRejectsPaths(t *testing.T) {
+	w := &Watcher{}
+	if _, err := w.render(testNetwork(t, "ipsec", `{"../10-rancher.conf": {}}`), metadata.Host{}); err == nil {
+		t.Errorf("expected an error for a file name outside the config directory")
+	}
+}
+
+func TestRenderValidates(t *testing.T) {
+	defer setupCNIPath(t, "rancher-bridge", "rancher-cni-ipam")()
+
+	w := &Watcher{}
+	for _, config := range []string{
+		`{}`,
+		`{"10-rancher.conf": []}`,
+		`{"10-rancher.conf": {"type": "rancher-brdige"}}`,
+		`{"10-rancher.conf": {"type": "rancher-bridge", "cniVersion": "9.9.9"}}`,
+		`{"10-rancher.conf": {"type": "rancher-bridge", "ipam": {"type": "host-local"}}}`,
+		`{"10-rancher.conf": {"type": "rancher-bridge", "ipam": {"type": "rancher-cni-ipam", "subnet": "10.42.0.0"}}}`,
+		`{"10-rancher.conf": {"type": "rancher-bridge", "ipam": {"type": "rancher-cni-ipam", "routes": [{"dst": "bogus"}]}}}`,
+		`{"10-rancher.conflist": {"plugins": []}}`,
+	} {
+		if _, err := w.render(testNetwork(t, "ipsec", config), metadata.Host{}); err == nil {
+			t.Errorf("expected an error for %s", config)
+		}
+	}
+
+	config := `{"10-rancher.conf": {"type": "rancher-bridge", "cniVersion": "0.3.1", "ipam": {
+  "type": "rancher-cni-ipam",
+  "subnet": "10.42.0.0/16",
+  "routes": [{"dst": "0.0.0.0/0", "gw": "10.42.0.1"}],
+  "ranges": [[{"subnet": "10.42.0.0/24", "gateway": "10.42.0.1"}]]
+}}}`
+	if _, err := w.render(testNetwork(t, "ipsec", config), metadata.Host{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestApplyKeepsLastGoodConfig(t *testing.T) {
+	defer setupCNIDir(t)()
+	defer setupCNIPath(t, "rancher-bridge")()
+
+	w := &Watcher{
+		applied: map[string]metadata.Network{},
+		invalid: map[string]InvalidNetwork{},
+	}
+	if err := w.apply(testNetwork(t, "ipsec", `{"10-rancher.conf": {"type": "rancher-bridge"}}`), metadata.Host{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	good := readConfDir(t, "ipsec")
+
+	if err := w.apply(testNetwork(t, "ipsec", `{"10-rancher.conf": {"type": "rancher-brdige"}}`), metadata.Host{}); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if files := readConfDir(t, "ipsec"); !reflect.DeepEqual(files, good) {
+		t.Errorf("expected the previous config to be kept, got %v", files)
+	}
+	if status := w.Status(); len(status.Invalid) != 1 || status.Invalid[0].Network != "ipsec" {
+		t.Errorf("expected ipsec to be reported as invalid, got %+v", status)
+	}
+
+	w.prune(map[string]bool{})
+	if status := w.Status(); len(status.Invalid) != 0 {
+		t.Errorf("expected no invalid network after prune, got %+v", status)
+	}
+}
+
+func TestSwapConfDir(t *testing.T) {
+	defer setupCNIDir(t)()
+
+	// A directory written by older versions is replaced by a symlink
+	legacy := filepath.Join(cniRoot(), "ipsec.d")
+	os.MkdirAll(legacy, 0700)
+	ioutil.WriteFile(filepath.Join(legacy, "old.conf"), []byte("{}"), 0600)
+
+	if err := swapConfDir("ipsec", map[string][]byte{"10-rancher.conf": []byte("a")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first, err := os.Readlink(legacy)
+	if err != nil || !strings.HasPrefix(first, ".ipsec.d-") {
+		t.Fatalf("expected ipsec.d to link to a version directory, got %q, %v", first, err)
+	}
+	if files := readConfDir(t, "ipsec"); len(files) != 1 || files["10-rancher.conf"] != "a" {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	// Same content, nothing to do
+	if err := swapConfDir("ipsec", map[string][]byte{"10-rancher.conf": []byte("a")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if target, _ := os.Readlink(legacy); target != first {
+		t.Errorf("expected no swap, got %q", target)
+	}
+
+	if err := swapConfDir("ipsec", map[string][]byte{"20-other.conf": []byte("b")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if files := readConfDir(t, "ipsec"); len(files) != 1 || files["20-other.conf"] != "b" {
+		t.Errorf("stale file not removed: %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(cniRoot(), first)); !os.IsNotExist(err) {
+		t.Errorf("expected the previous version directory to be removed, got %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	defer setupCNIDir(t)()
+
+	for _, name := range []string{"ipsec", "vxlan"} {
+		if err := swapConfDir(name, map[string][]byte{"10-rancher.conf": []byte(name)}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	unrelated := filepath.Join(cniRoot(), "net.d")
+	os.MkdirAll(unrelated, 0700)
+	if err := setManagedLink("vxlan"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := &Watcher{applied: map[string]metadata.Network{}}
+	if err := w.prune(map[string]bool{"ipsec": true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := setManagedLink(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries, _ := ioutil.ReadDir(cniRoot())
+	names := []string{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".ipsec.d-") {
+			names = append(names, entry.Name())
+		}
+	}
+	if strings.Join(names, ",") != "ipsec.d,net.d" {
+		t.Errorf("unexpected entries after prune: %v", names)
+	}
+	if len(entries) != 3 {
+		t.Errorf("expected a single version directory for ipsec, got %d entries", len(entries))
+	}
+}
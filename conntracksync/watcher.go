@@ -2,7 +2,6 @@ package conntracksync
 
 import (
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -62,9 +61,9 @@ func (ctw *ConntrackTableWatcher) onChangeNoError(version string) {
 }
 
 func (ctw *ConntrackTableWatcher) doSync() error {
-	containersMap, err := ctw.buildContainersMaps()
+	hostPorts, err := ctw.buildHostPorts()
 	if err != nil {
-		logrus.Errorf("conntracksync: error building containersMap")
+		logrus.Errorf("conntracksync: error building hostPorts")
 		return err
 	}
 
@@ -75,16 +74,9 @@ func (ctw *ConntrackTableWatcher) doSync() error {
 	}
 
 	for _, ctEntry := range dCTEntries {
-		var c *metadata.Container
-		var specificEntryFound, genericEntryFound bool
-		specificKey := ctEntry.OriginalDestinationIP + ":" + ctEntry.OriginalDestinationPort + "/" + ctEntry.Protocol
-		c, specificEntryFound = containersMap[specificKey]
-		if !specificEntryFound {
-			genericKey := "0.0.0.0:" + ctEntry.OriginalDestinationPort + "/" + ctEntry.Protocol
-			c, genericEntryFound = containersMap[genericKey]
-			if !genericEntryFound {
-				continue
-			}
+		c := findContainer(hostPorts, ctEntry.OriginalDestinationIP, ctEntry.OriginalDestinationPort, ctEntry.Protocol)
+		if c == nil {
+			continue
 		}
 		if c.PrimaryIp != "" && ctEntry.ReplySourceIP != c.PrimaryIp {
 			logrus.Infof("conntracksync: deleting mismatching DNAT conntrack entry found: %v. [expected: %v, got: %v]", ctEntry, c.PrimaryIp, ctEntry.ReplySourceIP)
@@ -101,16 +93,9 @@ func (ctw *ConntrackTableWatcher) doSync() error {
 	}
 
 	for _, ctEntry := range sCTEntries {
-		var c *metadata.Container
-		var specificEntryFound, genericEntryFound bool
-		specificKey := ctEntry.ReplyDestinationIP + ":" + ctEntry.ReplyDestinationPort + "/" + ctEntry.Protocol
-		c, specificEntryFound = containersMap[specificKey]
-		if !specificEntryFound {
-			genericKey := "0.0.0.0:" + ctEntry.ReplyDestinationPort + "/" + ctEntry.Protocol
-			c, genericEntryFound = containersMap[genericKey]
-			if !genericEntryFound {
-				continue
-			}
+		c := findContainer(hostPorts, ctEntry.ReplyDestinationIP, ctEntry.ReplyDestinationPort, ctEntry.Protocol)
+		if c == nil {
+			continue
 		}
 		if c.PrimaryIp != "" && ctEntry.OriginalSourceIP != c.PrimaryIp {
 			logrus.Infof("conntracksync: deleting mismatching SNAT conntrack entry found: %v. [expected: %v, got: %v]", ctEntry, c.PrimaryIp, ctEntry.OriginalSourceIP)
@@ -123,8 +108,33 @@ func (ctw *ConntrackTableWatcher) doSync() error {
 	return nil
 }
 
-func (ctw *ConntrackTableWatcher) buildContainersMaps() (
-	map[string]*metadata.Container, error) {
+// hostPort is a range of host ports published by a container
+type hostPort struct {
+	ip        string
+	ports     utils.PortRange
+	protocol  string
+	container *metadata.Container
+}
+
+// findContainer returns the container publishing the port on the IP, or on
+// all the addresses of the host if none publishes it on that IP
+func findContainer(hostPorts []hostPort, ip, port, protocol string) *metadata.Container {
+	var generic *metadata.Container
+	for _, hp := range hostPorts {
+		if hp.protocol != protocol || !hp.ports.Contains(port) {
+			continue
+		}
+		if hp.ip == ip {
+			return hp.container
+		}
+		if hp.ip == "0.0.0.0" && generic == nil {
+			generic = hp.container
+		}
+	}
+	return generic
+}
+
+func (ctw *ConntrackTableWatcher) buildHostPorts() ([]hostPort, error) {
 	host, err := ctw.mc.GetSelfHost()
 	if err != nil {
 		logrus.Errorf("conntracksync: error fetching self host from metadata")
@@ -136,7 +146,7 @@ func (ctw *ConntrackTableWatcher) buildContainersMaps() (
 		logrus.Errorf("conntracksync: error fetching containers from metadata")
 		return nil, err
 	}
-	containersMap := make(map[string]*metadata.Container)
+	var hostPorts []hostPort
 	for index, aContainer := range containers {
 		if !(aContainer.HostUUID == host.UUID &&
 			utils.IsContainerConsideredRunning(aContainer) &&
@@ -145,22 +155,20 @@ func (ctw *ConntrackTableWatcher) buildContainersMaps() (
 		}
 
 		for _, aPort := range aContainer.Ports {
-			protocol := "tcp"
-			splits := strings.Split(aPort, ":")
-			if len(splits) != 3 {
+			def, err := utils.ParsePortDef(aPort)
+			if err != nil {
+				logrus.Debugf("conntracksync: ignoring port: %v", err)
 				continue
 			}
-			hostIP := splits[0]
-			hostPort := splits[1]
-			targetPort := splits[2]
-			parts := strings.Split(targetPort, "/")
-			if len(parts) == 2 {
-				protocol = parts[1]
-			}
 
-			containersMap[hostIP+":"+hostPort+"/"+protocol] = &containers[index]
+			hostPorts = append(hostPorts, hostPort{
+				ip:        def.HostIP,
+				ports:     def.HostPort,
+				protocol:  def.Protocol,
+				container: &containers[index],
+			})
 		}
 	}
 
-	return containersMap, nil
+	return hostPorts, nil
 }
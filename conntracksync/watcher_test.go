@@ -0,0 +1,34 @@
+package conntracksync
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/utils"
+)
+
+func TestFindContainer(t *testing.T) {
+	generic := &metadata.Container{PrimaryIp: "10.42.0.2"}
+	specific := &metadata.Container{PrimaryIp: "10.42.0.3"}
+	hostPorts := []hostPort{
+		{ip: "0.0.0.0", ports: utils.PortRange{Start: 8000, End: 8010}, protocol: "udp", container: generic},
+		{ip: "192.168.0.1", ports: utils.PortRange{Start: 8005, End: 8005}, protocol: "udp", container: specific},
+	}
+
+	tests := []struct {
+		ip, port, protocol string
+		c                  *metadata.Container
+	}{
+		{"192.168.0.2", "8000", "udp", generic},
+		{"192.168.0.2", "8010", "udp", generic},
+		{"192.168.0.1", "8005", "udp", specific},
+		{"192.168.0.1", "8006", "udp", generic},
+		{"192.168.0.2", "8011", "udp", nil},
+		{"192.168.0.2", "8000", "tcp", nil},
+	}
+	for _, test := range tests {
+		if c := findContainer(hostPorts, test.ip, test.port, test.protocol); c != test.c {
+			t.Errorf("%s:%s/%s: expected %v, got %v", test.ip, test.port, test.protocol, test.c, c)
+		}
+	}
+}
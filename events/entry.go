@@ -4,6 +4,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/rancher/plugin-manager/binexec"
+	"github.com/rancher/plugin-manager/macsync"
 	"github.com/rancher/plugin-manager/network"
 )
 
@@ -11,11 +12,12 @@ const (
 	simulatedEvent = "-simulated-"
 )
 
-func Watch(poolSize int, nm *network.Manager, bw *binexec.Watcher, disableDNSSetup bool) error {
+func Watch(poolSize int, nm *network.Manager, bw *binexec.Watcher, ms *macsync.MACSyncer, disableDNSSetup bool) error {
 	dep := &DockerEventsProcessor{
 		poolSize:        poolSize,
 		nm:              nm,
 		bw:              bw,
+		ms:              ms,
 		disableDNSSetup: disableDNSSetup,
 	}
 	return dep.Process()
@@ -25,6 +27,7 @@ type DockerEventsProcessor struct {
 	poolSize        int
 	nm              *network.Manager
 	bw              *binexec.Watcher
+	ms              *macsync.MACSyncer
 	disableDNSSetup bool
 }
 
@@ -39,6 +42,7 @@ func (de *DockerEventsProcessor) Process() error {
 	if !de.disableDNSSetup {
 		log.Infof("enabling dns setup")
 		startHandler = &StartHandler{dockerClient}
+		de.nm.SetDNSSetup(startHandler.SetupDependent)
 	} else {
 		log.Infof("disabling dns setup")
 	}
@@ -47,8 +51,10 @@ func (de *DockerEventsProcessor) Process() error {
 			de.bw,
 			startHandler,
 			nmHandler,
+			de.ms,
 		},
 		"die": {
+			de.bw,
 			nmHandler,
 		},
 	}
@@ -18,6 +18,7 @@ const (
 	RancherDNSPriority = "io.rancher.container.dns.priority"
 	RancherNetwork     = "io.rancher.container.network"
 	CNILabel           = "io.rancher.cni.network"
+	CNINetworksLabel   = "io.rancher.cni.networks"
 )
 
 type StartHandler struct {
@@ -150,7 +151,7 @@ func (h *StartHandler) Handle(event *docker.APIEvents) error {
 		return nil
 	}
 
-	if c.Config.Labels[CNILabel] != "" || c.Config.Labels[RancherDNS] == "true" ||
+	if c.Config.Labels[CNILabel] != "" || c.Config.Labels[CNINetworksLabel] != "" || c.Config.Labels[RancherDNS] == "true" ||
 		c.Config.Labels[RancherNetwork] == "true" {
 		log.Infof("Setting up resolv.conf for ContainerId [%s]", event.ID)
 		return setupResolvConf(c)
@@ -158,3 +159,19 @@ func (h *StartHandler) Handle(event *docker.APIEvents) error {
 
 	return nil
 }
+
+// SetupDependent sets up resolv.conf for a container sharing the netns of
+// another container, when the network of that one comes up again
+func (h *StartHandler) SetupDependent(id string) error {
+	c, err := h.Client.InspectContainer(id)
+	if err != nil {
+		return err
+	}
+
+	if !c.State.Running || c.Config.Labels[RancherDNS] == "false" {
+		return nil
+	}
+
+	log.Infof("Setting up resolv.conf for dependent ContainerId [%s]", id)
+	return setupResolvConf(c)
+}
@@ -118,10 +118,12 @@ func (w *watcher) onChange(version string) error {
 }
 
 func (w *watcher) networkToRule(network metadata.Network, host metadata.Host) *MASQRule {
-	conf, _ := network.Metadata["cniConfig"].(map[string]interface{})
-	for _, file := range conf {
-		file = utils.UpdateCNIConfigByKeywords(file, host)
-		props, _ := file.(map[string]interface{})
+	conf, err := utils.NetworkCNIConfig(network, host)
+	if err != nil {
+		logrus.Errorf("Failed to get the cni config of network %s: %v", network.Name, err)
+		return nil
+	}
+	for _, props := range utils.CNIPluginConfigs(conf) {
 		hostNat, _ := props["hostNat"].(bool)
 		cniType, _ := props["type"].(string)
 		bridge, _ := props["bridge"].(string)
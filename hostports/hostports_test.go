@@ -0,0 +1,91 @@
+package hostports
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/utils"
+)
+
+var (
+	port80   = utils.PortRange{Start: 80, End: 80}
+	port8080 = utils.PortRange{Start: 8080, End: 8080}
+)
+
+func TestParsePortRules(t *testing.T) {
+	v4 := PortRule{SourceIP: "0.0.0.0", SourcePort: port80, TargetIP: "10.42.0.2", TargetPort: port8080, Protocol: "tcp"}
+	v6 := PortRule{SourceIP: "::", SourcePort: port80, TargetIP: "fd00::2", TargetPort: port8080, Protocol: "tcp", IPv6: true}
+
+	tests := []struct {
+		portDef    string
+		targetIPv6 string
+		rules      []PortRule
+	}{
+		{"0.0.0.0:80:8080/tcp", "", []PortRule{v4}},
+		{"0.0.0.0:80:8080/tcp", "fd00::2", []PortRule{v4, v6}},
+		{"[::]:80:8080/tcp", "fd00::2", []PortRule{v4, v6}},
+		{"[::]:80:8080", "", []PortRule{v4}},
+		{"[2001:db8::1]:80:8080/tcp", "fd00::2", []PortRule{{SourceIP: "2001:db8::1", SourcePort: port80, TargetIP: "fd00::2", TargetPort: port8080, Protocol: "tcp", IPv6: true}}},
+		{"[2001:db8::1]:80:8080/tcp", "", nil},
+		{"192.168.0.1:80:8080/tcp", "fd00::2", []PortRule{{SourceIP: "192.168.0.1", SourcePort: port80, TargetIP: "10.42.0.2", TargetPort: port8080, Protocol: "tcp"}}},
+		{"80:8080/tcp", "", []PortRule{v4}},
+		{"[::]80:8080/tcp", "fd00::2", nil},
+		{"0.0.0.0:80:8080:tcp", "", nil},
+		{"0.0.0.0:8000-8010:9000-9010/udp", "", nil},
+		{"8000-8010:8000-8010/udp", "", []PortRule{{SourceIP: "0.0.0.0", SourcePort: utils.PortRange{Start: 8000, End: 8010},
+			TargetIP: "10.42.0.2", TargetPort: utils.PortRange{Start: 8000, End: 8010}, Protocol: "udp"}}},
+	}
+	for _, test := range tests {
+		if rules := parsePortRules("", "10.42.0.2", test.targetIPv6, test.portDef); !reflect.DeepEqual(rules, test.rules) {
+			t.Errorf("%s: expected %v, got %v", test.portDef, test.rules, rules)
+		}
+	}
+}
+
+func TestContainerIPs(t *testing.T) {
+	c := metadata.Container{PrimaryIp: "10.42.0.2", Ips: []string{"fe80::1", "fd00::2/64", "10.42.0.3"}}
+	if ipv4, ipv6 := containerIPs(c); ipv4 != "10.42.0.2" || ipv6 != "fd00::2" {
+		t.Errorf("unexpected addresses %s %s", ipv4, ipv6)
+	}
+}
+
+func TestRulesIPv6(t *testing.T) {
+	w := &watcher{metadataAddress: "169.254.169.250", metadataListenPort: "8080"}
+	rules := parsePortRules("docker0", "10.42.0.2", "fd00::2", "0.0.0.0:80:8080/tcp")
+	m := map[string]PortRule{"a/v4": rules[0], "a/v6": rules[1]}
+
+	v6 := w.rules(m, true).String()
+	for _, expected := range []string{
+		"-A CATTLE_RAW_PREROUTING ! -i docker0 -p tcp --dport 80 -j MARK --set-mark 4200",
+		"-A CATTLE_PREROUTING -p tcp -m tcp --dport 80 -m addrtype --dst-type LOCAL -j DNAT --to-destination [fd00::2]:8080",
+		"-A CATTLE_HOSTPORTS_POSTROUTING -s fd00::2 -d fd00::2 -p tcp -m tcp --dport 8080 -j MASQUERADE",
+	} {
+		if !strings.Contains(v6, expected) {
+			t.Errorf("expected %q in\n%s", expected, v6)
+		}
+	}
+	if strings.Contains(v6, "10.42.0.2") || strings.Contains(v6, "169.254.169.250") {
+		t.Errorf("unexpected IPv4 rules in\n%s", v6)
+	}
+
+	if v4 := w.rules(m, false).String(); strings.Contains(v4, "fd00::2") || !strings.Contains(v4, "--to-destination 10.42.0.2:8080") {
+		t.Errorf("unexpected IPv4 rules\n%s", v4)
+	}
+}
+
+func TestRulesPortRange(t *testing.T) {
+	w := &watcher{metadataListenPort: "80"}
+	rules := parsePortRules("", "10.42.0.2", "", "0.0.0.0:8000-8010:8000-8010/udp")
+	out := w.rules(map[string]PortRule{"a": rules[0]}, false).String()
+	for _, expected := range []string{
+		"-A CATTLE_RAW_PREROUTING -p udp --dport 8000:8010 -j MARK --set-mark 4200",
+		"-A CATTLE_PREROUTING -p udp -m udp --dport 8000:8010 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.42.0.2:8000-8010",
+		"-A CATTLE_HOSTPORTS_POSTROUTING -s 10.42.0.2 -d 10.42.0.2 -p udp -m udp --dport 8000:8010 -j MASQUERADE",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in\n%s", expected, out)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package hostports
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"reflect"
@@ -47,14 +49,30 @@ type watcher struct {
 }
 
 // PortRule is used to store the needed information for building a
-// iptables rule
+// iptables rule, or a ip6tables rule if IPv6 is set
 type PortRule struct {
 	Bridge     string
 	SourceIP   string
-	SourcePort string
+	SourcePort utils.PortRange
 	TargetIP   string
-	TargetPort string
+	TargetPort utils.PortRange
 	Protocol   string
+	IPv6       bool
+}
+
+// wildcard tells if the rule is for all the addresses of the host
+func (p PortRule) wildcard() bool {
+	return p.SourceIP == "0.0.0.0" || p.SourceIP == "::"
+}
+
+// target returns the DNAT destination, IPv6 addresses are bracketed. The
+// destination port of a range is kept when it's in the target range, so
+// that identical ranges are mapped port to port.
+func (p PortRule) target() string {
+	if p.IPv6 {
+		return fmt.Sprintf("[%s]:%s", p.TargetIP, p.TargetPort)
+	}
+	return fmt.Sprintf("%s:%s", p.TargetIP, p.TargetPort)
 }
 
 func (p PortRule) prefix() []byte {
@@ -65,12 +83,12 @@ func (p PortRule) prefix() []byte {
 	}
 	buf.WriteString(" -p ")
 	buf.WriteString(p.Protocol)
-	if p.SourceIP != "0.0.0.0" {
+	if !p.wildcard() {
 		buf.WriteString(" -d ")
 		buf.WriteString(p.SourceIP)
 	}
 	buf.WriteString(" --dport ")
-	buf.WriteString(p.SourcePort)
+	buf.WriteString(p.SourcePort.IPTables())
 	return buf.Bytes()
 }
 
@@ -93,54 +111,52 @@ func (p PortRule) natIptables() []byte {
 	buf.WriteString("-A CATTLE_PREROUTING")
 	buf.Write(p.prefix())
 	buf.WriteString(" -j DNAT --to ")
-	buf.WriteString(p.TargetIP)
-	buf.WriteString(":")
-	buf.WriteString(p.TargetPort)
+	buf.WriteString(p.target())
 
-	if p.SourceIP == "0.0.0.0" {
-		buf.WriteString(fmt.Sprintf("\n-A CATTLE_PREROUTING -p %v -m %v --dport %v -m addrtype --dst-type LOCAL -j DNAT --to-destination %v:%v",
-			p.Protocol, p.Protocol, p.SourcePort, p.TargetIP, p.TargetPort))
+	if p.wildcard() {
+		buf.WriteString(fmt.Sprintf("\n-A CATTLE_PREROUTING -p %v -m %v --dport %v -m addrtype --dst-type LOCAL -j DNAT --to-destination %v",
+			p.Protocol, p.Protocol, p.SourcePort.IPTables(), p.target()))
 
-		buf.WriteString(fmt.Sprintf("\n-A CATTLE_OUTPUT -p %v -m %v --dport %v -m addrtype --dst-type LOCAL -j DNAT --to-destination %v:%v",
-			p.Protocol, p.Protocol, p.SourcePort, p.TargetIP, p.TargetPort))
+		buf.WriteString(fmt.Sprintf("\n-A CATTLE_OUTPUT -p %v -m %v --dport %v -m addrtype --dst-type LOCAL -j DNAT --to-destination %v",
+			p.Protocol, p.Protocol, p.SourcePort.IPTables(), p.target()))
 	} else {
-		buf.WriteString(fmt.Sprintf("\n-A CATTLE_PREROUTING -p %v -m %v --dport %v -d %v -j DNAT --to-destination %v:%v",
-			p.Protocol, p.Protocol, p.SourcePort, p.SourceIP, p.TargetIP, p.TargetPort))
+		buf.WriteString(fmt.Sprintf("\n-A CATTLE_PREROUTING -p %v -m %v --dport %v -d %v -j DNAT --to-destination %v",
+			p.Protocol, p.Protocol, p.SourcePort.IPTables(), p.SourceIP, p.target()))
 
-		buf.WriteString(fmt.Sprintf("\n-A CATTLE_OUTPUT -p %v -m %v --dport %v -d %v -j DNAT --to-destination %v:%v",
-			p.Protocol, p.Protocol, p.SourcePort, p.SourceIP, p.TargetIP, p.TargetPort))
+		buf.WriteString(fmt.Sprintf("\n-A CATTLE_OUTPUT -p %v -m %v --dport %v -d %v -j DNAT --to-destination %v",
+			p.Protocol, p.Protocol, p.SourcePort.IPTables(), p.SourceIP, p.target()))
 	}
 
 	buf.WriteString(fmt.Sprintf("\n-A %s -s %v -d %v -p %v -m %v --dport %v -j MASQUERADE",
-		hostPortsPostRoutingChain, p.TargetIP, p.TargetIP, p.Protocol, p.Protocol, p.TargetPort))
+		hostPortsPostRoutingChain, p.TargetIP, p.TargetIP, p.Protocol, p.Protocol, p.TargetPort.IPTables()))
 
 	return buf.Bytes()
 }
 
-func (w *watcher) insertBaseRules() error {
+func (w *watcher) insertBaseRules(iptables string) error {
 	var e error
-	if w.run("iptables", "-w", "-t", "raw", "-C", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_RAW_PREROUTING") != nil {
-		if err := w.run("iptables", "-w", "-t", "raw", "-I", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_RAW_PREROUTING"); err != nil {
+	if w.run(iptables, "-w", "-t", "raw", "-C", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_RAW_PREROUTING") != nil {
+		if err := w.run(iptables, "-w", "-t", "raw", "-I", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_RAW_PREROUTING"); err != nil {
 			e = errors.Wrap(e, err.Error())
 		}
 	}
-	if w.run("iptables", "-w", "-t", "nat", "-C", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_PREROUTING") != nil {
-		if err := w.run("iptables", "-w", "-t", "nat", "-I", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_PREROUTING"); err != nil {
+	if w.run(iptables, "-w", "-t", "nat", "-C", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_PREROUTING") != nil {
+		if err := w.run(iptables, "-w", "-t", "nat", "-I", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_PREROUTING"); err != nil {
 			e = errors.Wrap(e, err.Error())
 		}
 	}
-	if w.run("iptables", "-w", "-C", "FORWARD", "-j", "CATTLE_FORWARD") != nil {
-		if err := w.run("iptables", "-w", "-I", "FORWARD", "-j", "CATTLE_FORWARD"); err != nil {
+	if w.run(iptables, "-w", "-C", "FORWARD", "-j", "CATTLE_FORWARD") != nil {
+		if err := w.run(iptables, "-w", "-I", "FORWARD", "-j", "CATTLE_FORWARD"); err != nil {
 			e = errors.Wrap(e, err.Error())
 		}
 	}
-	if w.run("iptables", "-w", "-t", "nat", "-C", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_OUTPUT") != nil {
-		if err := w.run("iptables", "-w", "-t", "nat", "-I", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_OUTPUT"); err != nil {
+	if w.run(iptables, "-w", "-t", "nat", "-C", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_OUTPUT") != nil {
+		if err := w.run(iptables, "-w", "-t", "nat", "-I", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_OUTPUT"); err != nil {
 			e = errors.Wrap(e, err.Error())
 		}
 	}
-	if w.run("iptables", "-w", "-t", "nat", "-C", "POSTROUTING", "-j", hostPortsPostRoutingChain) != nil {
-		if err := w.run("iptables", "-w", "-t", "nat", "-I", "POSTROUTING", "-j", hostPortsPostRoutingChain); err != nil {
+	if w.run(iptables, "-w", "-t", "nat", "-C", "POSTROUTING", "-j", hostPortsPostRoutingChain) != nil {
+		if err := w.run(iptables, "-w", "-t", "nat", "-I", "POSTROUTING", "-j", hostPortsPostRoutingChain); err != nil {
 			e = errors.Wrap(e, err.Error())
 		}
 	}
@@ -194,9 +210,11 @@ func (w *watcher) onChange(version string) error {
 			continue
 		}
 
-		conf, _ := network.Metadata["cniConfig"].(map[string]interface{})
-		for _, file := range conf {
-			props, _ := file.(map[string]interface{})
+		conf, err := utils.NetworkCNIConfig(network, host)
+		if err != nil {
+			logrus.Errorf("Failed to get the cni config of network %s: %v", network.Name, err)
+		}
+		for _, props := range utils.CNIPluginConfigs(conf) {
 			cniType, _ := props["type"].(string)
 			checkBridge, _ := props["bridge"].(string)
 
@@ -205,13 +223,15 @@ func (w *watcher) onChange(version string) error {
 			}
 		}
 
+		ipv4, ipv6 := containerIPs(container)
 		for _, port := range container.Ports {
-			rule, ok := parsePortRule(bridge, host.AgentIP, container.PrimaryIp, port)
-			if !ok {
-				continue
+			for _, rule := range parsePortRules(bridge, ipv4, ipv6, port) {
+				key := container.ExternalId + "/" + port
+				if rule.IPv6 {
+					key += "/ipv6"
+				}
+				newPortRules[key] = rule
 			}
-
-			newPortRules[container.ExternalId+"/"+port] = rule
 		}
 	}
 
@@ -228,11 +248,33 @@ func (w *watcher) onChange(version string) error {
 }
 
 func (w *watcher) apply(rules map[string]PortRule) error {
+	if err := w.restore("iptables", w.rules(rules, false)); err != nil {
+		return err
+	}
+
+	// ip6tables is left alone on hosts which never had IPv6 host ports,
+	// it may not even be usable there
+	if hasIPv6(rules) || hasIPv6(w.applied) || w.chainExists("ip6tables", "nat", "CATTLE_PREROUTING") {
+		if err := w.restore("ip6tables", w.rules(rules, true)); err != nil {
+			return err
+		}
+	}
+
+	w.applied = rules
+	w.lastApplied = time.Now()
+	return nil
+}
+
+// rules renders the restore input of the IPv4 or IPv6 rules
+func (w *watcher) rules(rules map[string]PortRule, ipv6 bool) *bytes.Buffer {
 	buf := &bytes.Buffer{}
 	buf.WriteString("*raw\n")
 	buf.WriteString(":CATTLE_RAW_PREROUTING -\n")
 	buf.WriteString("-F CATTLE_RAW_PREROUTING\n")
 	for _, rule := range rules {
+		if rule.IPv6 != ipv6 {
+			continue
+		}
 		buf.WriteString("\n")
 		buf.Write(rule.rawIptables())
 	}
@@ -249,12 +291,15 @@ func (w *watcher) apply(rules map[string]PortRule) error {
 	buf.WriteString("-F CATTLE_OUTPUT\n")
 	buf.WriteString(fmt.Sprintf("-F %s\n", hostPortsPostRoutingChain))
 
-	if w.metadataListenPort != "80" {
+	if !ipv6 && w.metadataListenPort != "80" {
 		buf.WriteString(fmt.Sprintf("-A CATTLE_PREROUTING -d %s/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 169.254.169.250:%s\n", w.metadataAddress, w.metadataListenPort))
 		buf.WriteString(fmt.Sprintf("-A CATTLE_OUTPUT -d %s/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 169.254.169.250:%s\n", w.metadataAddress, w.metadataListenPort))
 	}
 
 	for _, rule := range rules {
+		if rule.IPv6 != ipv6 {
+			continue
+		}
 		buf.WriteString("\n")
 		buf.Write(rule.natIptables())
 	}
@@ -266,52 +311,118 @@ func (w *watcher) apply(rules map[string]PortRule) error {
 	buf.WriteString("-A CATTLE_FORWARD -m mark --mark 0x4000 -j ACCEPT\n")
 
 	buf.WriteString("\nCOMMIT\n")
+	return buf
+}
 
+// restore applies the rules with iptables-restore or ip6tables-restore and
+// makes sure the base rules jump to the chains
+func (w *watcher) restore(iptables string, buf *bytes.Buffer) error {
 	if logrus.GetLevel() == logrus.DebugLevel {
-		fmt.Printf("Applying rules\n%s", buf)
+		fmt.Printf("Applying %s rules\n%s", iptables, buf)
 	}
 
-	cmd := exec.Command("iptables-restore", "-n")
+	cmd := exec.Command(iptables+"-restore", "-n")
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
-	cmd.Stdin = buf
+	cmd.Stdin = bytes.NewReader(buf.Bytes())
 	if err := cmd.Run(); err != nil {
 		logrus.Errorf("Failed to apply port rules\n%s", buf)
 		return err
 	}
 
-	if err := w.insertBaseRules(); err != nil {
-		return errors.Wrap(err, "Applying port base iptables rules")
+	if err := w.insertBaseRules(iptables); err != nil {
+		return errors.Wrapf(err, "Applying port base %s rules", iptables)
 	}
-
-	w.applied = rules
-	w.lastApplied = time.Now()
 	return nil
 }
 
-func parsePortRule(bridge, hostIP, targetIP, portDef string) (PortRule, bool) {
-	proto := "tcp"
-	parts := strings.Split(portDef, ":")
-	if len(parts) != 3 {
-		return PortRule{}, false
+func (w *watcher) chainExists(iptables, table, chain string) bool {
+	cmd := exec.Command(iptables, "-w", "-t", table, "-S", chain)
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = ioutil.Discard
+	return cmd.Run() == nil
+}
+
+func hasIPv6(rules map[string]PortRule) bool {
+	for _, rule := range rules {
+		if rule.IPv6 {
+			return true
+		}
 	}
+	return false
+}
 
-	sourceIP, sourcePort, targetPort := parts[0], parts[1], parts[2]
+// containerIPs returns the IPv4 and IPv6 addresses of the container, empty
+// if it has none of that family
+func containerIPs(container metadata.Container) (string, string) {
+	ipv4, ipv6 := "", ""
+	for _, s := range append([]string{container.PrimaryIp}, container.Ips...) {
+		ip := net.ParseIP(strings.Split(s, "/")[0])
+		switch {
+		case ip == nil || ip.IsLinkLocalUnicast():
+		case ip.To4() != nil && ipv4 == "":
+			ipv4 = ip.String()
+		case ip.To4() == nil && ipv6 == "":
+			ipv6 = ip.String()
+		}
+	}
+	return ipv4, ipv6
+}
 
-	parts = strings.Split(targetPort, "/")
-	if len(parts) == 2 {
-		targetPort = parts[0]
-		proto = parts[1]
+// parsePortRules returns the rules of a port definition like
+// 0.0.0.0:80:8080/tcp, [::]:80:8080/tcp or 8000-8010:8000-8010/udp. The
+// binds to all the addresses get a rule for each family the container has
+// an address of.
+func parsePortRules(bridge, targetIP, targetIPv6, portDef string) []PortRule {
+	def, err := utils.ParsePortDef(portDef)
+	if err != nil {
+		logrus.Errorf("Ignoring host port: %v", err)
+		return nil
 	}
+	sourceIP, sourcePort, targetPort, proto := def.HostIP, def.HostPort, def.TargetPort, def.Protocol
 
-	return PortRule{
-		Bridge:     bridge,
-		SourceIP:   sourceIP,
-		SourcePort: sourcePort,
-		TargetIP:   targetIP,
-		TargetPort: targetPort,
-		Protocol:   proto,
-	}, true
+	// netfilter only keeps the port in a DNAT range, shifted ranges can't be
+	// mapped port to port
+	if targetPort.Len() > 1 && targetPort != sourcePort {
+		logrus.Errorf("Ignoring host port %s: the target range has to be the same as the host one", portDef)
+		return nil
+	}
+
+	ip := net.ParseIP(sourceIP)
+	wildcard := ip.IsUnspecified()
+	isIPv6 := ip.To4() == nil
+
+	var rules []PortRule
+	if targetIP != "" && (!isIPv6 || wildcard) {
+		sourceIPv4 := sourceIP
+		if wildcard {
+			sourceIPv4 = "0.0.0.0"
+		}
+		rules = append(rules, PortRule{
+			Bridge:     bridge,
+			SourceIP:   sourceIPv4,
+			SourcePort: sourcePort,
+			TargetIP:   targetIP,
+			TargetPort: targetPort,
+			Protocol:   proto,
+		})
+	}
+	if targetIPv6 != "" && (isIPv6 || wildcard) {
+		sourceIPv6 := ip.String()
+		if wildcard {
+			sourceIPv6 = "::"
+		}
+		rules = append(rules, PortRule{
+			Bridge:     bridge,
+			SourceIP:   sourceIPv6,
+			SourcePort: sourcePort,
+			TargetIP:   targetIPv6,
+			TargetPort: targetPort,
+			Protocol:   proto,
+			IPv6:       true,
+		})
+	}
+	return rules
 }
 
 func networksByUUID(c metadata.Client) (map[string]metadata.Network, error) {
@@ -338,5 +449,16 @@ func setupKernelParameters() error {
 		return err
 	}
 	logrus.Debugf("Running %s, output: %s", s, outBuf.String())
+
+	// Only needed for IPv6 host ports, hosts without IPv6 may not have it
+	s = "net.bridge.bridge-nf-call-ip6tables=1"
+	outBuf.Reset()
+	cmd = exec.Command("sysctl", "-w", s)
+	cmd.Stdout = &outBuf
+	if err := cmd.Run(); err != nil {
+		logrus.Warnf("error setting up kernel parameters: %v", err)
+		return nil
+	}
+	logrus.Debugf("Running %s, output: %s", s, outBuf.String())
 	return nil
 }
@@ -0,0 +1,76 @@
+package ipsync
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func parseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	ret := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("parsing %s: %v", cidr, err)
+		}
+		ipNet.IP = ip.To4()
+		ret = append(ret, ipNet)
+	}
+	return ret
+}
+
+func TestGetNetworkConfig(t *testing.T) {
+	cniConf := map[string]interface{}{}
+	json.Unmarshal([]byte(`{"10-rancher.conf": {
+  "bridge": "docker0",
+  "bridgeSubnet": "10.42.0.1/16",
+  "isDefaultGateway": true,
+  "type": "rancher-bridge"
+}}`), &cniConf)
+
+	config, err := getNetworkConfig(cniConf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Bridge != "docker0" || config.Subnet.String() != "10.42.0.0/16" || !config.IsDefaultGateway {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	if _, err := getNetworkConfig(map[string]interface{}{}); err == nil {
+		t.Errorf("expected an error without bridgeSubnet")
+	}
+}
+
+func TestGetExpectedAddrs(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.42.0.0/16")
+	aContainer := metadata.Container{
+		PrimaryIp: "10.42.0.5",
+		Ips:       []string{"10.42.0.5", "10.42.3.7", "192.168.1.10", "fd00::1", "bogus"},
+	}
+
+	expected := parseCIDRs(t, "10.42.0.5/16", "10.42.3.7/16", "192.168.1.10/32")
+	actual := getExpectedAddrs(aContainer, subnet)
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i].String() != expected[i].String() {
+			t.Errorf("expected %v, got %v", expected[i], actual[i])
+		}
+	}
+}
+
+func TestDiffAddrs(t *testing.T) {
+	toAdd, toDel := diffAddrs(
+		parseCIDRs(t, "10.42.0.5/16", "10.42.9.9/16", "10.42.0.6/24"),
+		parseCIDRs(t, "10.42.0.5/16", "10.42.0.6/16"),
+	)
+	if len(toAdd) != 1 || toAdd[0].String() != "10.42.0.6/16" {
+		t.Errorf("unexpected addresses to add %v", toAdd)
+	}
+	if len(toDel) != 2 || toDel[0].String() != "10.42.9.9/16" || toDel[1].String() != "10.42.0.6/24" {
+		t.Errorf("unexpected addresses to remove %v", toDel)
+	}
+}
@@ -0,0 +1,289 @@
+package ipsync
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/docker/engine-api/client"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/network"
+	"github.com/rancher/plugin-manager/utils"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	// DefaultSyncInterval specifies the default value for ipsync interval in seconds
+	DefaultSyncInterval = 60
+	syncLabel           = "io.rancher.network.ipsync"
+	containerIfName     = "eth0"
+)
+
+// IPWatcher checks periodically that the eth0 of the containers holds
+// the IPs and the default route found in rancher-metadata, and fixes
+// them if not
+type IPWatcher struct {
+	syncInterval time.Duration
+	mc           metadata.Client
+	dc           *client.Client
+	lastApplied  time.Time
+}
+
+// networkConfig is what's needed from the CNI config of a network to
+// check the addresses of its containers
+type networkConfig struct {
+	Bridge           string
+	Subnet           *net.IPNet
+	IsDefaultGateway bool
+}
+
+// Watch starts the go routine to periodically check the IPs of the
+// containers
+func Watch(syncIntervalStr string, mc metadata.Client, dc *client.Client) error {
+	logrus.Debugf("ipsync: syncIntervalStr: %v", syncIntervalStr)
+
+	syncInterval := DefaultSyncInterval
+	if i, err := strconv.Atoi(syncIntervalStr); err == nil {
+		syncInterval = i
+	}
+
+	iw := &IPWatcher{
+		syncInterval: time.Duration(syncInterval) * time.Second,
+		mc:           mc,
+		dc:           dc,
+	}
+
+	go mc.OnChange(120, iw.onChangeNoError)
+
+	return nil
+}
+
+func (iw *IPWatcher) onChangeNoError(version string) {
+	logrus.Debugf("ipsync: metadata version: %v, lastApplied: %v", version, iw.lastApplied)
+	timeSinceLastApplied := time.Now().Sub(iw.lastApplied)
+	if timeSinceLastApplied < iw.syncInterval {
+		timeToSleep := iw.syncInterval - timeSinceLastApplied
+		logrus.Debugf("ipsync: sleeping for %v", timeToSleep)
+		time.Sleep(timeToSleep)
+	}
+	if err := iw.doSync(); err != nil {
+		logrus.Errorf("ipsync: while syncing, got error: %v", err)
+	}
+	iw.lastApplied = time.Now()
+}
+
+func (iw *IPWatcher) doSync() error {
+	localNetworks, routers, err := network.LocalNetworks(iw.mc)
+	if err != nil {
+		return errors.Wrap(err, "get local networks")
+	}
+
+	host, err := iw.mc.GetSelfHost()
+	if err != nil {
+		return errors.Wrap(err, "get self host")
+	}
+
+	var lastError error
+	for _, localNetwork := range localNetworks {
+		if routers[localNetwork.UUID].Labels[syncLabel] != "true" {
+			continue
+		}
+
+		cniConf, err := utils.NetworkCNIConfig(localNetwork, host)
+		if err != nil {
+			logrus.Errorf("ipsync: network %v: %v", localNetwork.UUID, err)
+			lastError = err
+			continue
+		}
+		config, err := getNetworkConfig(cniConf)
+		if err != nil {
+			logrus.Errorf("ipsync: network %v: %v", localNetwork.UUID, err)
+			lastError = err
+			continue
+		}
+
+		gateway := getGateway(config)
+		logrus.Debugf("ipsync: network %v, config: %+v, gateway: %v", localNetwork.UUID, config, gateway)
+
+		err = network.ForEachContainerNS(iw.dc, iw.mc, localNetwork.UUID, func(aContainer metadata.Container, _ ns.NetNS) error {
+			return syncContainer(aContainer, config.Subnet, gateway)
+		})
+		if err != nil {
+			lastError = err
+		}
+	}
+
+	return lastError
+}
+
+func getNetworkConfig(cniConf map[string]interface{}) (*networkConfig, error) {
+	config := &networkConfig{}
+	subnet := ""
+	for _, props := range utils.CNIPluginConfigs(cniConf) {
+		if b, ok := props["bridge"].(string); ok {
+			config.Bridge = b
+		}
+		if s, ok := props["bridgeSubnet"].(string); ok {
+			subnet = s
+		}
+		if g, ok := props["isDefaultGateway"].(bool); ok {
+			config.IsDefaultGateway = g
+		}
+	}
+
+	if subnet == "" {
+		return nil, fmt.Errorf("no bridgeSubnet in the CNI config")
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridgeSubnet %v: %v", subnet, err)
+	}
+	config.Subnet = ipNet
+
+	return config, nil
+}
+
+// getGateway returns the address of the bridge in the subnet when it's the
+// default gateway of the containers, nil otherwise
+func getGateway(config *networkConfig) net.IP {
+	if !config.IsDefaultGateway || config.Bridge == "" {
+		return nil
+	}
+
+	l, err := netlink.LinkByName(config.Bridge)
+	if err != nil {
+		logrus.Debugf("ipsync: bridge %v not found: %v", config.Bridge, err)
+		return nil
+	}
+
+	addrs, err := netlink.AddrList(l, netlink.FAMILY_V4)
+	if err != nil {
+		logrus.Errorf("ipsync: error listing addresses of bridge %v: %v", config.Bridge, err)
+		return nil
+	}
+	for _, addr := range addrs {
+		if config.Subnet.Contains(addr.IP) {
+			return addr.IP
+		}
+	}
+
+	return nil
+}
+
+// getExpectedAddrs returns the addresses a container should have on eth0,
+// the ones outside of the subnet are host addresses
+func getExpectedAddrs(aContainer metadata.Container, subnet *net.IPNet) []*net.IPNet {
+	expected := []*net.IPNet{}
+	seen := map[string]bool{}
+	for _, ipStr := range append([]string{aContainer.PrimaryIp}, aContainer.Ips...) {
+		ip := net.ParseIP(ipStr).To4()
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+
+		mask := net.CIDRMask(32, 32)
+		if subnet.Contains(ip) {
+			mask = subnet.Mask
+		}
+		expected = append(expected, &net.IPNet{IP: ip, Mask: mask})
+	}
+	return expected
+}
+
+// diffAddrs returns the addresses to add and the ones to remove to go from
+// actual to expected
+func diffAddrs(actual, expected []*net.IPNet) ([]*net.IPNet, []*net.IPNet) {
+	actualMap := map[string]bool{}
+	for _, a := range actual {
+		actualMap[a.String()] = true
+	}
+	expectedMap := map[string]bool{}
+	for _, e := range expected {
+		expectedMap[e.String()] = true
+	}
+
+	toAdd, toDel := []*net.IPNet{}, []*net.IPNet{}
+	for _, e := range expected {
+		if !actualMap[e.String()] {
+			toAdd = append(toAdd, e)
+		}
+	}
+	for _, a := range actual {
+		if !expectedMap[a.String()] {
+			toDel = append(toDel, a)
+		}
+	}
+	return toAdd, toDel
+}
+
+func syncContainer(aContainer metadata.Container, subnet *net.IPNet, gateway net.IP) error {
+	l, err := netlink.LinkByName(containerIfName)
+	if err != nil {
+		return fmt.Errorf("container %v: could not lookup interface: %v", aContainer.ExternalId, err)
+	}
+
+	addrs, err := netlink.AddrList(l, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("container %v: could not list addresses: %v", aContainer.ExternalId, err)
+	}
+	actual := []*net.IPNet{}
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			actual = append(actual, addr.IPNet)
+		}
+	}
+
+	toAdd, toDel := diffAddrs(actual, getExpectedAddrs(aContainer, subnet))
+	var lastError error
+	for _, a := range toAdd {
+		logrus.Infof("ipsync: container %v: adding missing address %v", aContainer.ExternalId, a)
+		if err := netlink.AddrAdd(l, &netlink.Addr{IPNet: a}); err != nil {
+			lastError = fmt.Errorf("container %v: could not add address %v: %v", aContainer.ExternalId, a, err)
+		}
+	}
+	for _, a := range toDel {
+		logrus.Infof("ipsync: container %v: removing foreign address %v", aContainer.ExternalId, a)
+		if err := netlink.AddrDel(l, &netlink.Addr{IPNet: a}); err != nil {
+			lastError = fmt.Errorf("container %v: could not remove address %v: %v", aContainer.ExternalId, a, err)
+		}
+	}
+
+	if gateway != nil {
+		if err := syncDefaultRoute(aContainer, l, gateway); err != nil {
+			lastError = err
+		}
+	}
+
+	return lastError
+}
+
+func syncDefaultRoute(aContainer metadata.Container, l netlink.Link, gateway net.IP) error {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("container %v: could not list routes: %v", aContainer.ExternalId, err)
+	}
+
+	for _, route := range routes {
+		if route.Dst != nil {
+			continue
+		}
+		if route.Gw.Equal(gateway) && route.LinkIndex == l.Attrs().Index {
+			return nil
+		}
+		logrus.Infof("ipsync: container %v: removing wrong default route via %v", aContainer.ExternalId, route.Gw)
+		if err := netlink.RouteDel(&route); err != nil {
+			return fmt.Errorf("container %v: could not remove default route: %v", aContainer.ExternalId, err)
+		}
+	}
+
+	logrus.Infof("ipsync: container %v: adding default route via %v", aContainer.ExternalId, gateway)
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: l.Attrs().Index, Gw: gateway}); err != nil {
+		return fmt.Errorf("container %v: could not add default route: %v", aContainer.ExternalId, err)
+	}
+	return nil
+}
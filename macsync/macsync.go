@@ -3,98 +3,122 @@ package macsync
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/docker/engine-api/client"
+	"github.com/fsouza/go-dockerclient"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/plugin-manager/network"
 	"github.com/vishvananda/netlink"
 )
 
-// MACSyncer ...
+// MACSyncer syncs the MAC addresses of the running containers on the
+// host with info from metadata. Every container is checked periodically,
+// and on metadata changes or container starts only the affected ones are.
 type MACSyncer struct {
-	dc *client.Client
-	mc metadata.Client
+	sync.Mutex
+	dc           *client.Client
+	mc           metadata.Client
+	syncInterval time.Duration
+	// synced holds the MAC address last synced for every container
+	synced map[string]string
 }
 
 var (
-	syncLabel    = "io.rancher.network.macsync"
-	syncInterval = 15 * time.Second
-	// N for 2 min
-	N = 8
+	// DefaultSyncInterval specifies the default value for macsync interval in seconds
+	DefaultSyncInterval = 15
+	syncLabel           = "io.rancher.network.macsync"
 )
 
-// SyncMACAddresses syncs the MAC addresses of all the running
-// containers on the host with info from metadata. This is
-// especillay needed during an upgrade when the MAC of the
-// container was not set during a prior release
-func SyncMACAddresses(mc metadata.Client, dockerClient *client.Client) {
-	ms := MACSyncer{
-		mc: mc,
-		dc: dockerClient,
+// Watch starts the go routines syncing the MAC addresses periodically and
+// on metadata changes. The returned syncer also handles container start
+// events.
+func Watch(syncIntervalStr string, mc metadata.Client, dockerClient *client.Client) (*MACSyncer, error) {
+	logrus.Debugf("macsync: syncIntervalStr: %v", syncIntervalStr)
+
+	syncInterval := DefaultSyncInterval
+	if i, err := strconv.Atoi(syncIntervalStr); err == nil {
+		syncInterval = i
+	}
+
+	ms := &MACSyncer{
+		mc:           mc,
+		dc:           dockerClient,
+		syncInterval: time.Duration(syncInterval) * time.Second,
+		synced:       map[string]string{},
 	}
 
-	go ms.syncNTimes()
+	go ms.syncPeriodically()
+	go mc.OnChange(120, ms.onChangeNoError)
+
+	return ms, nil
 }
 
-func (ms *MACSyncer) syncNTimes() {
+func (ms *MACSyncer) syncPeriodically() {
 	for {
-		if done, err := ms.doSync(); err != nil {
-			logrus.Errorf("macsync: error syncing MAC addresses for the first tiime: %v", err)
-		} else if done {
-			break
+		if err := ms.doSync(); err != nil {
+			logrus.Errorf("macsync: error syncing MAC addresses: %v", err)
 		}
-		time.Sleep(syncInterval)
+		time.Sleep(ms.syncInterval)
 	}
+}
 
-	for i := 0; i < N; i++ {
-		time.Sleep(syncInterval)
-		if _, err := ms.doSync(); err != nil {
-			logrus.Errorf("macsync: i: %v, error syncing MAC addresses: %v", i, err)
-		}
+func (ms *MACSyncer) onChangeNoError(version string) {
+	logrus.Debugf("macsync: metadata version: %v", version)
+	if err := ms.sync(ms.changed); err != nil {
+		logrus.Errorf("macsync: error syncing MAC addresses on metadata change: %v", err)
 	}
 }
 
-func (ms *MACSyncer) doSync() (bool, error) {
-	didSomething := false
+// Handle syncs the MAC address of a container that just started
+func (ms *MACSyncer) Handle(event *docker.APIEvents) error {
+	return ms.sync(func(aContainer metadata.Container) bool {
+		return aContainer.ExternalId == event.ID
+	})
+}
+
+// changed tells whether the MAC address of a container in metadata isn't
+// the one last synced
+func (ms *MACSyncer) changed(aContainer metadata.Container) bool {
+	return ms.synced[aContainer.ExternalId] != aContainer.PrimaryMacAddress
+}
+
+func (ms *MACSyncer) doSync() error {
+	return ms.sync(nil)
+}
+
+// sync checks the containers accepted by match, or all of them if match
+// is nil
+func (ms *MACSyncer) sync(match func(metadata.Container) bool) error {
+	ms.Lock()
+	defer ms.Unlock()
 
 	networks, routers, err := network.LocalNetworks(ms.mc)
 	if err != nil {
-		return didSomething, errors.Wrap(err, "getting local networks")
+		return errors.Wrap(err, "getting local networks")
 	}
 
+	seen := map[string]bool{}
 	var lastError error
 	for _, n := range networks {
 		if routers[n.UUID].Labels[syncLabel] != "true" {
 			continue
 		}
 
-		didSomething = true
-		err := network.ForEachContainerNS(ms.dc, ms.mc, n.UUID, func(aContainer metadata.Container, _ ns.NetNS) error {
-			l, err := netlink.LinkByName("eth0")
-			if err != nil {
-				logrus.Errorf("macsync: for container: %v, could not lookup interface: %v",
-					aContainer, err)
+		err := network.ForEachMatchingContainerNS(ms.dc, ms.mc, n.UUID, func(aContainer metadata.Container) bool {
+			seen[aContainer.ExternalId] = true
+			return match == nil || match(aContainer)
+		}, func(aContainer metadata.Container, _ ns.NetNS) error {
+			if err := syncMAC(aContainer); err != nil {
 				return err
 			}
-			foundMAC := l.Attrs().HardwareAddr.String()
-			if !strings.EqualFold(aContainer.PrimaryMacAddress, foundMAC) {
-				logrus.Infof("macsync: fixing container %v MAC address, found=%v, expected: %v",
-					aContainer.ExternalId, foundMAC, aContainer.PrimaryMacAddress)
-
-				hwaddr, err := net.ParseMAC(aContainer.PrimaryMacAddress)
-				if err != nil {
-					return fmt.Errorf("failed to parse MAC address: %v", err)
-				}
-				err = netlink.LinkSetHardwareAddr(l, hwaddr)
-				if err != nil {
-					return fmt.Errorf("failed to set hw address of interface: %v", err)
-				}
-			}
+			ms.synced[aContainer.ExternalId] = aContainer.PrimaryMacAddress
 			return nil
 		})
 		if err != nil {
@@ -102,5 +126,37 @@ func (ms *MACSyncer) doSync() (bool, error) {
 		}
 	}
 
-	return didSomething, lastError
+	if match == nil && lastError == nil {
+		for id := range ms.synced {
+			if !seen[id] {
+				delete(ms.synced, id)
+			}
+		}
+	}
+
+	return lastError
+}
+
+func syncMAC(aContainer metadata.Container) error {
+	l, err := netlink.LinkByName("eth0")
+	if err != nil {
+		logrus.Errorf("macsync: for container: %v, could not lookup interface: %v",
+			aContainer, err)
+		return err
+	}
+	foundMAC := l.Attrs().HardwareAddr.String()
+	if !strings.EqualFold(aContainer.PrimaryMacAddress, foundMAC) {
+		logrus.Infof("macsync: fixing container %v MAC address, found=%v, expected: %v",
+			aContainer.ExternalId, foundMAC, aContainer.PrimaryMacAddress)
+
+		hwaddr, err := net.ParseMAC(aContainer.PrimaryMacAddress)
+		if err != nil {
+			return fmt.Errorf("failed to parse MAC address: %v", err)
+		}
+		err = netlink.LinkSetHardwareAddr(l, hwaddr)
+		if err != nil {
+			return fmt.Errorf("failed to set hw address of interface: %v", err)
+		}
+	}
+	return nil
 }
@@ -30,8 +30,9 @@ func TestDoSync(t *testing.T) {
 		t.Fail()
 	}
 	ms := MACSyncer{
-		mc: mc,
-		dc: dClient,
+		mc:     mc,
+		dc:     dClient,
+		synced: map[string]string{},
 	}
 
 	ms.doSync()
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/client"
@@ -16,9 +21,13 @@ import (
 	"github.com/rancher/plugin-manager/events"
 	"github.com/rancher/plugin-manager/hostnat"
 	"github.com/rancher/plugin-manager/hostports"
+	"github.com/rancher/plugin-manager/ipsync"
 	"github.com/rancher/plugin-manager/macsync"
+	"github.com/rancher/plugin-manager/mtusync"
 	"github.com/rancher/plugin-manager/network"
 	"github.com/rancher/plugin-manager/routesync"
+	"github.com/rancher/plugin-manager/status"
+	"github.com/rancher/plugin-manager/utils"
 	"github.com/rancher/plugin-manager/vethsync"
 	"github.com/urfave/cli"
 )
@@ -48,6 +57,11 @@ func main() {
 			Name:  "disable-macsync",
 			Usage: "Disable macsync",
 		},
+		cli.StringFlag{
+			Name:  "macsync-interval",
+			Usage: fmt.Sprintf("Customize the interval of macsync in seconds (default: %v)", macsync.DefaultSyncInterval),
+			Value: "",
+		},
 		cli.BoolFlag{
 			Name:  "disable-dns-setup",
 			Usage: "Disable setting up of resolv.conf",
@@ -88,19 +102,215 @@ func main() {
 			Usage: fmt.Sprintf("Customize the interval of vethsync in seconds (default: %v)", vethsync.DefaultSyncInterval),
 			Value: "",
 		},
+		cli.BoolFlag{
+			Name:  "disable-ipsync",
+			Usage: "Disable ipsync",
+		},
+		cli.StringFlag{
+			Name:  "ipsync-interval",
+			Usage: fmt.Sprintf("Customize the interval of ipsync in seconds (default: %v)", ipsync.DefaultSyncInterval),
+			Value: "",
+		},
+		cli.BoolFlag{
+			Name:  "disable-mtusync",
+			Usage: "Disable mtusync",
+		},
+		cli.StringFlag{
+			Name:  "mtusync-interval",
+			Usage: fmt.Sprintf("Customize the interval of mtusync in seconds (default: %v)", mtusync.DefaultSyncInterval),
+			Value: "",
+		},
 		cli.BoolFlag{
 			Name:  "disable-cni-setup",
 			Usage: "Disable setting up CNI config and binaries",
 		},
+		cli.StringFlag{
+			Name:  "cni-overrides-dir",
+			Usage: "Directory of the per host overrides of the CNI config, <network>.json merge patches",
+			Value: utils.CNIOverridesDir,
+		},
+		cli.BoolFlag{
+			Name:  "cni-conflist",
+			Usage: "Render the CNI config of every network as a single .conflist",
+		},
+		cli.BoolFlag{
+			Name:  "cni-kubernetes",
+			Usage: "Also render the default network and the driver binaries for a kubelet running on the host",
+		},
+		cli.StringFlag{
+			Name:  "cni-kubernetes-conf-dir",
+			Usage: "Directory kubelet loads the CNI config from",
+			Value: "/etc/cni/net.d",
+		},
+		cli.StringFlag{
+			Name:  "cni-kubernetes-bin-dir",
+			Usage: "Directory kubelet looks up the CNI binaries in",
+			Value: "/opt/cni/bin",
+		},
+		cli.IntFlag{
+			Name:  "cni-kubernetes-priority",
+			Usage: "Priority prefix of the CNI config for kubelet, which uses the first config in lexical order",
+			Value: 10,
+		},
+		cli.BoolFlag{
+			Name:  "disable-cni-reconcile",
+			Usage: "Disable periodic reconciliation of container networks",
+		},
+		cli.StringFlag{
+			Name:  "cni-reconcile-interval",
+			Usage: fmt.Sprintf("Customize the interval of CNI reconciliation in seconds (default: %v)", network.DefaultReconcileInterval),
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "cni-retry-interval",
+			Usage: fmt.Sprintf("Customize the first interval between CNI network up retries in seconds (default: %v)", network.DefaultRetryInterval),
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "cni-retry-max-interval",
+			Usage: fmt.Sprintf("Customize the maximum interval between CNI network up retries in seconds (default: %v)", network.DefaultRetryMaxInterval),
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "cni-max-retries",
+			Usage: fmt.Sprintf("Customize the number of CNI network up retries (default: %v)", network.DefaultMaxRetries),
+			Value: "",
+		},
+		cli.BoolFlag{
+			Name:  "disable-cni-gc",
+			Usage: "Disable cleaning up the network state of removed containers on startup",
+		},
+		cli.BoolFlag{
+			Name:  "cni-gc-dry-run",
+			Usage: "Only report the network state of removed containers on startup",
+		},
+		cli.BoolFlag{
+			Name:  "disable-duplicate-ip-check",
+			Usage: "Disable checking that container IPs aren't already in use when bringing up their network",
+		},
+		cli.StringFlag{
+			Name:  "status-listen-address",
+			Usage: "Address the status API listens on",
+			Value: status.DefaultListenAddress,
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "Turn on debug logging",
 		},
 	}
 	app.Action = run
+	app.Commands = []cli.Command{
+		{
+			Name:      "status",
+			Usage:     "Print the status reported by a running plugin-manager",
+			ArgsUsage: "[subsystem]",
+			Action:    printStatus,
+		},
+		{
+			Name:  "state",
+			Usage: "Inspect the persisted network state of the containers",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "state-dir",
+					Usage: "Directory holding the network state",
+					Value: network.DefaultStateDir,
+				},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:   "ls",
+					Usage:  "List the latest network state of every container",
+					Action: listState,
+				},
+				{
+					Name:      "show",
+					Usage:     "Show the network state and attempt history of a container",
+					ArgsUsage: "<container>",
+					Action:    showState,
+				},
+			},
+		},
+	}
 	app.Run(os.Args)
 }
 
+func printStatus(c *cli.Context) error {
+	content, err := status.Get(c.GlobalString("status-listen-address"), c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, content, "", "  "); err != nil {
+		return err
+	}
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+func listState(c *cli.Context) error {
+	store := network.NewStore(c.Parent().String("state-dir"))
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tSTARTED\tNETWORK\tIP\tRETRIES\tERROR")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%.12s\t%s\t%s\t%s\t%d\t%s\n",
+			entry.ContainerID,
+			entry.StartedAt,
+			strings.Join(entry.Record.Networks(), ","),
+			strings.Join(entry.Record.IPs(), ","),
+			entry.Record.Retries,
+			entry.Record.Error)
+	}
+	return w.Flush()
+}
+
+func showState(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("a container ID is required")
+	}
+
+	store := network.NewStore(c.Parent().String("state-dir"))
+	id, err := store.Find(c.Args().First())
+	if err != nil {
+		return err
+	}
+	history, err := store.History(id)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		return fmt.Errorf("no network state for container %s", id)
+	}
+
+	latest := history[len(history)-1]
+	fmt.Printf("Container:  %s\n", id)
+	fmt.Printf("Started:    %s\n", latest.StartedAt)
+	fmt.Printf("Networks:   %s\n", strings.Join(latest.Record.Networks(), ","))
+	fmt.Printf("IPs:        %s\n", strings.Join(latest.Record.IPs(), ","))
+	fmt.Printf("Retries:    %d\n", latest.Record.Retries)
+	fmt.Printf("Failed:     %v\n", latest.Record.Failed)
+	fmt.Printf("Last error: %s\n", latest.Record.Error)
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tATTEMPT\tRESULT")
+	for _, entry := range history {
+		for _, attempt := range entry.Record.Attempts {
+			result := "ok"
+			if attempt.Error != "" {
+				result = attempt.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", entry.StartedAt, attempt.Time.Format(time.RFC3339), result)
+		}
+	}
+	return w.Flush()
+}
+
 func unmountVolumes() {
 	cmd := exec.Command("umount.sh")
 	cmd.Stdout = os.Stdout
@@ -118,6 +328,8 @@ func run(c *cli.Context) error {
 
 	go unmountVolumes()
 
+	utils.CNIOverridesDir = c.String("cni-overrides-dir")
+
 	if !c.Bool("disable-routesync") {
 		if err := routesync.Watch(c.String("routesync-interval")); err != nil {
 			logrus.Errorf("Failed to start routesync: %v", err)
@@ -130,11 +342,6 @@ func run(c *cli.Context) error {
 		return err
 	}
 
-	manager, err := network.NewManager(dClient)
-	if err != nil {
-		return err
-	}
-
 	metadataURL := fmt.Sprintf(metadataURLTemplate, c.String("metadata-address"), c.String("metadata-listen-port"))
 	logrus.Infof("Waiting for metadata")
 	mClient, err := metadata.NewClientAndWait(metadataURL)
@@ -142,8 +349,22 @@ func run(c *cli.Context) error {
 		return errors.Wrap(err, "Creating metadata client")
 	}
 
+	retryConfig := network.NewRetryConfig(c.String("cni-retry-interval"), c.String("cni-retry-max-interval"), c.String("cni-max-retries"))
+	manager, err := network.NewManager(dClient, mClient, retryConfig)
+	if err != nil {
+		return err
+	}
+	manager.SetDuplicateIPCheck(!c.Bool("disable-duplicate-ip-check"))
+	status.Register("network", func() interface{} {
+		return manager.Status()
+	})
+	status.ListenAndServe(c.String("status-listen-address"))
+
+	var macSyncer *macsync.MACSyncer
 	if !c.Bool("disable-macsync") {
-		macsync.SyncMACAddresses(mClient, dClient)
+		if macSyncer, err = macsync.Watch(c.String("macsync-interval"), mClient, dClient); err != nil {
+			logrus.Errorf("Failed to start macsync: %v", err)
+		}
 	}
 
 	if err := hostports.Watch(mClient, c.String("metadata-address"), c.String("metadata-listen-port")); err != nil {
@@ -160,12 +381,6 @@ func run(c *cli.Context) error {
 		}
 	}
 
-	if !c.Bool("disable-cni-setup") {
-		if err := cniconf.Watch(mClient); err != nil {
-			logrus.Errorf("Failed to start cni config: %v", err)
-		}
-	}
-
 	if !c.Bool("disable-arpsync") {
 		if err := arpsync.Watch(c.String("arpsync-interval"), mClient, dClient); err != nil {
 			logrus.Errorf("Failed to start arpsync: %v", err)
@@ -178,12 +393,57 @@ func run(c *cli.Context) error {
 		}
 	}
 
+	if !c.Bool("disable-ipsync") {
+		if err := ipsync.Watch(c.String("ipsync-interval"), mClient, dClient); err != nil {
+			logrus.Errorf("Failed to start ipsync: %v", err)
+		}
+	}
+
+	if !c.Bool("disable-mtusync") {
+		if err := mtusync.Watch(c.String("mtusync-interval"), mClient, dClient); err != nil {
+			logrus.Errorf("Failed to start mtusync: %v", err)
+		}
+	}
+
 	var binWatcher *binexec.Watcher
 	if !c.Bool("disable-cni-setup") {
-		binWatcher = binexec.Watch(mClient, dClient)
+		kubeletBinDir := ""
+		if c.Bool("cni-kubernetes") {
+			kubeletBinDir = c.String("cni-kubernetes-bin-dir")
+		}
+		binWatcher = binexec.Watch(mClient, dClient, kubeletBinDir)
+	}
+
+	// Run after the binaries are set up, they are checked when validating
+	// the config
+	if !c.Bool("disable-cni-setup") {
+		opts := cniconf.Options{
+			ConfList: c.Bool("cni-conflist"),
+		}
+		if c.Bool("cni-kubernetes") {
+			opts.KubernetesConfDir = c.String("cni-kubernetes-conf-dir")
+			opts.KubernetesPriority = c.Int("cni-kubernetes-priority")
+		}
+		confWatcher, err := cniconf.Watch(mClient, opts)
+		if err != nil {
+			logrus.Errorf("Failed to start cni config: %v", err)
+		} else {
+			status.Register("cniconf", func() interface{} {
+				return confWatcher.Status()
+			})
+		}
+	}
+
+	// Run after the binaries are set up, DEL needs the driver wrappers
+	if !c.Bool("disable-cni-gc") {
+		manager.CollectGarbage(c.Bool("cni-gc-dry-run"))
+	}
+
+	if !c.Bool("disable-cni-reconcile") {
+		manager.Reconcile(c.String("cni-reconcile-interval"))
 	}
 
-	if err := events.Watch(100, manager, binWatcher, c.Bool("disable-dns-setup")); err != nil {
+	if err := events.Watch(100, manager, binWatcher, macSyncer, c.Bool("disable-dns-setup")); err != nil {
 		return err
 	}
 
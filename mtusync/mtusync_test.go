@@ -0,0 +1,64 @@
+package mtusync
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGetNetworkMTU(t *testing.T) {
+	for _, c := range []struct {
+		conf     string
+		uplink   int
+		expected networkMTU
+		ok       bool
+	}{
+		{`{"10-rancher.conf": {"type": "rancher-bridge", "bridge": "docker0", "mtu": 1400}}`, 1500, networkMTU{"docker0", 1400, 0}, true},
+		{`{"10-rancher.conf": {"type": "rancher-bridge", "bridge": "docker0", "linkMTUOverhead": 98}}`, 1500, networkMTU{"docker0", 1500, 98}, true},
+		{`{"10-rancher.conf": {"type": "rancher-bridge", "bridge": "docker0", "linkMTUOverhead": 98}}`, 0, networkMTU{"docker0", 0, 98}, false},
+		{`{"10-rancher.conflist": {"plugins": [{"type": "rancher-bridge", "bridge": "docker0"}, {"type": "tuning", "mtu": 9000}]}}`, 1500, networkMTU{"docker0", 9000, 0}, true},
+		{`{"10-rancher.conf": {"type": "rancher-bridge", "bridge": "docker0"}}`, 1500, networkMTU{"docker0", 0, 0}, false},
+	} {
+		conf := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(c.conf), &conf); err != nil {
+			t.Fatalf("parsing %s: %v", c.conf, err)
+		}
+		actual, ok := getNetworkMTU(conf, c.uplink)
+		if actual != c.expected || ok != c.ok {
+			t.Errorf("%s: expected %+v, %v, got %+v, %v", c.conf, c.expected, c.ok, actual, ok)
+		}
+	}
+}
+
+func TestStockIPSecMTU(t *testing.T) {
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(`{"10-rancher.conf": {
+		"name": "rancher-cni-network",
+		"type": "rancher-bridge",
+		"bridge": "docker0",
+		"bridgeSubnet": "10.42.0.0/16",
+		"logToFile": "/var/log/rancher-cni.log",
+		"isDebugLevel": "false",
+		"isDefaultGateway": true,
+		"hostNat": true,
+		"hairpinMode": true,
+		"mtu": 1500,
+		"linkMTUOverhead": 98,
+		"ipam": {"type": "rancher-cni-ipam", "logToFile": "/var/log/rancher-cni.log", "isDebugLevel": "false"}
+	}}`), &conf); err != nil {
+		t.Fatalf("parsing config: %v", err)
+	}
+
+	wanted, ok := getNetworkMTU(conf, 9001)
+	if !ok || wanted.MTU != 1500 {
+		t.Fatalf("expected a bridge MTU of 1500, got %+v, %v", wanted, ok)
+	}
+	if mtu := wanted.containerMTU(nil); mtu != 1402 {
+		t.Errorf("expected a container MTU of 1402, got %v", mtu)
+	}
+	if mtu := wanted.containerMTU(map[string]string{linkMTUOverheadLabel: "150"}); mtu != 1350 {
+		t.Errorf("expected the label to override the overhead, got %v", mtu)
+	}
+	if mtu := wanted.containerMTU(map[string]string{linkMTUOverheadLabel: "bad"}); mtu != 1402 {
+		t.Errorf("expected an invalid label to be ignored, got %v", mtu)
+	}
+}
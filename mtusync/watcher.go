@@ -0,0 +1,241 @@
+package mtusync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/docker/engine-api/client"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/network"
+	"github.com/rancher/plugin-manager/utils"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	// DefaultSyncInterval specifies the default value for mtusync interval in seconds
+	DefaultSyncInterval  = 60
+	hostVethPrefix       = "vethr"
+	containerIfName      = "eth0"
+	linkMTUOverheadLabel = "io.rancher.cni.link_mtu_overhead"
+)
+
+// MTUWatcher checks periodically that the bridge, the host side veths
+// and the container interfaces of the local networks have the MTU
+// configured in the CNI config, and fixes them if not
+type MTUWatcher struct {
+	syncInterval time.Duration
+	mc           metadata.Client
+	dc           *client.Client
+	lastApplied  time.Time
+}
+
+// networkMTU is the MTU wanted for the links of a network. The bridge and
+// the host side veths get MTU, the container interfaces get MTU minus
+// Overhead, like rancher-bridge sets them up.
+type networkMTU struct {
+	Bridge   string
+	MTU      int
+	Overhead int
+}
+
+// containerMTU returns the MTU wanted for the interface of a container,
+// the io.rancher.cni.link_mtu_overhead label overrides the overhead of
+// the network
+func (n networkMTU) containerMTU(labels map[string]string) int {
+	overhead := n.Overhead
+	if value, ok := labels[linkMTUOverheadLabel]; ok {
+		if o, err := strconv.Atoi(value); err == nil && o >= 0 {
+			overhead = o
+		} else {
+			logrus.Warnf("mtusync: ignoring invalid %s label %q", linkMTUOverheadLabel, value)
+		}
+	}
+	return n.MTU - overhead
+}
+
+// Watch starts the go routine to periodically check the MTUs
+func Watch(syncIntervalStr string, mc metadata.Client, dc *client.Client) error {
+	logrus.Debugf("mtusync: syncIntervalStr: %v", syncIntervalStr)
+
+	syncInterval := DefaultSyncInterval
+	if i, err := strconv.Atoi(syncIntervalStr); err == nil {
+		syncInterval = i
+	}
+
+	mw := &MTUWatcher{
+		syncInterval: time.Duration(syncInterval) * time.Second,
+		mc:           mc,
+		dc:           dc,
+	}
+
+	go mc.OnChange(120, mw.onChangeNoError)
+
+	return nil
+}
+
+func (mw *MTUWatcher) onChangeNoError(version string) {
+	logrus.Debugf("mtusync: metadata version: %v, lastApplied: %v", version, mw.lastApplied)
+	timeSinceLastApplied := time.Now().Sub(mw.lastApplied)
+	if timeSinceLastApplied < mw.syncInterval {
+		timeToSleep := mw.syncInterval - timeSinceLastApplied
+		logrus.Debugf("mtusync: sleeping for %v", timeToSleep)
+		time.Sleep(timeToSleep)
+	}
+	if err := mw.doSync(); err != nil {
+		logrus.Errorf("mtusync: while syncing, got error: %v", err)
+	}
+	mw.lastApplied = time.Now()
+}
+
+func (mw *MTUWatcher) doSync() error {
+	localNetworks, _, err := network.LocalNetworks(mw.mc)
+	if err != nil {
+		return errors.Wrap(err, "get local networks")
+	}
+
+	host, err := mw.mc.GetSelfHost()
+	if err != nil {
+		return errors.Wrap(err, "get self host")
+	}
+
+	uplinkMTU, err := getUplinkMTU()
+	if err != nil {
+		logrus.Warnf("mtusync: couldn't find the uplink MTU: %v", err)
+	}
+
+	var lastError error
+	for _, localNetwork := range localNetworks {
+		cniConf, err := utils.NetworkCNIConfig(localNetwork, host)
+		if err != nil {
+			logrus.Errorf("mtusync: network %v: %v", localNetwork.UUID, err)
+			lastError = err
+			continue
+		}
+		wanted, ok := getNetworkMTU(cniConf, uplinkMTU)
+		if !ok {
+			continue
+		}
+		logrus.Debugf("mtusync: network %v wants %+v", localNetwork.UUID, wanted)
+
+		if err := syncHostLinks(wanted); err != nil {
+			logrus.Errorf("mtusync: error syncing host links of network %v: %v", localNetwork.UUID, err)
+			lastError = err
+		}
+
+		err = network.ForEachContainerNS(mw.dc, mw.mc, localNetwork.UUID, func(aContainer metadata.Container, _ ns.NetNS) error {
+			l, err := netlink.LinkByName(containerIfName)
+			if err != nil {
+				return fmt.Errorf("could not lookup interface: %v", err)
+			}
+			mtu := wanted.containerMTU(aContainer.Labels)
+			if mtu <= 0 {
+				return fmt.Errorf("invalid MTU %v for container %v", mtu, aContainer.ExternalId)
+			}
+			return setMTU(aContainer.ExternalId, l, mtu)
+		})
+		if err != nil {
+			lastError = err
+		}
+	}
+
+	return lastError
+}
+
+// getNetworkMTU returns the MTU set in the CNI config of a network and the
+// link MTU overhead of the overlay. Without MTU in the config, the uplink
+// MTU is used if there is an overhead. ok is false if the config has
+// neither.
+func getNetworkMTU(cniConf map[string]interface{}, uplinkMTU int) (networkMTU, bool) {
+	ret := networkMTU{}
+	hasOverhead := false
+	for _, props := range utils.CNIPluginConfigs(cniConf) {
+		if b, ok := props["bridge"].(string); ok {
+			ret.Bridge = b
+		}
+		if mtu, ok := props["mtu"].(float64); ok && mtu > 0 {
+			ret.MTU = int(mtu)
+		}
+		if o, ok := props["linkMTUOverhead"].(float64); ok && o >= 0 {
+			ret.Overhead, hasOverhead = int(o), true
+		}
+	}
+
+	if ret.MTU == 0 && hasOverhead {
+		ret.MTU = uplinkMTU
+	}
+
+	return ret, ret.MTU > ret.Overhead
+}
+
+// getUplinkMTU returns the MTU of the link of the default route
+func getUplinkMTU() (int, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, route := range routes {
+		if route.Dst != nil {
+			continue
+		}
+		l, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return 0, err
+		}
+		return l.Attrs().MTU, nil
+	}
+
+	return 0, fmt.Errorf("no default route")
+}
+
+// syncHostLinks fixes the MTU of the host side veths plugged into the
+// bridge, then the one of the bridge itself
+func syncHostLinks(wanted networkMTU) error {
+	if wanted.Bridge == "" {
+		return nil
+	}
+
+	bridge, err := netlink.LinkByName(wanted.Bridge)
+	if err != nil {
+		logrus.Debugf("mtusync: bridge %v not found: %v", wanted.Bridge, err)
+		return nil
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+
+	var lastError error
+	for _, l := range links {
+		if !strings.HasPrefix(l.Attrs().Name, hostVethPrefix) || l.Attrs().MasterIndex != bridge.Attrs().Index {
+			continue
+		}
+		if err := setMTU("host", l, wanted.MTU); err != nil {
+			lastError = err
+		}
+	}
+
+	if err := setMTU("host", bridge, wanted.MTU); err != nil {
+		lastError = err
+	}
+
+	return lastError
+}
+
+func setMTU(context string, l netlink.Link, mtu int) error {
+	if l.Attrs().MTU == mtu {
+		return nil
+	}
+
+	logrus.Infof("mtusync: %v: fixing MTU of %v, found: %v, expected: %v", context, l.Attrs().Name, l.Attrs().MTU, mtu)
+	if err := netlink.LinkSetMTU(l, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU of %v: %v", l.Attrs().Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	glue "github.com/rancher/cniglue"
+)
+
+const (
+	// CNIArgsLabelPrefix prefixes the labels passed as is in CNI_ARGS,
+	// io.rancher.cni.args.Foo=bar becomes Foo=bar
+	CNIArgsLabelPrefix = "io.rancher.cni.args."
+	// CapabilityArgsLabelPrefix prefixes the labels holding the JSON value
+	// of a CNI capability arg, e.g. io.rancher.cni.capability_args.ipRanges
+	CapabilityArgsLabelPrefix = "io.rancher.cni.capability_args."
+	portMappingsCapability    = "portMappings"
+)
+
+// portMapping is the portMappings capability arg format
+type portMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// labelPluginArgs returns the CNI args found in the labels, sorted by key.
+// Keys or values that can't be expressed in CNI_ARGS are skipped.
+func labelPluginArgs(labels map[string]string) [][2]string {
+	keys := []string{}
+	for label := range labels {
+		if strings.HasPrefix(label, CNIArgsLabelPrefix) {
+			keys = append(keys, label)
+		}
+	}
+	sort.Strings(keys)
+
+	args := [][2]string{}
+	for _, label := range keys {
+		key, value := strings.TrimPrefix(label, CNIArgsLabelPrefix), labels[label]
+		if key == "" || strings.ContainsAny(key, "=;") || strings.Contains(value, ";") {
+			logrus.Warnf("Skipping invalid CNI arg label %s=%s", label, value)
+			continue
+		}
+		args = append(args, [2]string{key, value})
+	}
+	return args
+}
+
+// capabilityArgs returns the CNI capability args of a container from its
+// labels. The portMappings default to the port bindings of the container.
+// Labels with invalid JSON are skipped, so that they never prevent a DEL.
+func capabilityArgs(state *glue.DockerPluginState) map[string]interface{} {
+	args := map[string]interface{}{}
+	for label, value := range state.Config.Labels {
+		if !strings.HasPrefix(label, CapabilityArgsLabelPrefix) {
+			continue
+		}
+		var arg interface{}
+		if err := json.Unmarshal([]byte(value), &arg); err != nil {
+			logrus.Warnf("Skipping invalid CNI capability arg label %s: %v", label, err)
+			continue
+		}
+		args[strings.TrimPrefix(label, CapabilityArgsLabelPrefix)] = arg
+	}
+
+	if _, ok := args[portMappingsCapability]; !ok {
+		if mappings := portMappings(state); len(mappings) > 0 {
+			args[portMappingsCapability] = mappings
+		}
+	}
+
+	return args
+}
+
+// portMappings returns the port bindings of the container. The bindings
+// without a host port are skipped, Docker picks a random one for them
+// which isn't known here.
+func portMappings(state *glue.DockerPluginState) []portMapping {
+	mappings := []portMapping{}
+	for port, bindings := range state.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			hostPort, err := strconv.Atoi(binding.HostPort)
+			if err != nil {
+				logrus.Debugf("Skipping port binding %s of %s without a fixed host port", port, state.ContainerID)
+				continue
+			}
+			mappings = append(mappings, portMapping{
+				HostPort:      hostPort,
+				ContainerPort: port.Int(),
+				Protocol:      port.Proto(),
+				HostIP:        binding.HostIP,
+			})
+		}
+	}
+	sort.Sort(byContainerPort(mappings))
+	return mappings
+}
+
+// byContainerPort sorts the port mappings by container port, protocol,
+// then host IP and port
+type byContainerPort []portMapping
+
+func (m byContainerPort) Len() int      { return len(m) }
+func (m byContainerPort) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byContainerPort) Less(i, j int) bool {
+	if m[i].ContainerPort != m[j].ContainerPort {
+		return m[i].ContainerPort < m[j].ContainerPort
+	}
+	if m[i].Protocol != m[j].Protocol {
+		return m[i].Protocol < m[j].Protocol
+	}
+	if m[i].HostIP != m[j].HostIP {
+		return m[i].HostIP < m[j].HostIP
+	}
+	return m[i].HostPort < m[j].HostPort
+}
+
+// runtimeConfig returns the capability args a plugin asks for in its
+// capabilities
+func runtimeConfig(plugin map[string]interface{}, args map[string]interface{}) map[string]interface{} {
+	capabilities, _ := plugin["capabilities"].(map[string]interface{})
+	config := map[string]interface{}{}
+	for name, enabled := range capabilities {
+		if value, ok := args[name]; ok && enabled == true {
+			config[name] = value
+		}
+	}
+	return config
+}
@@ -0,0 +1,66 @@
+package network
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/go-connections/nat"
+	glue "github.com/rancher/cniglue"
+)
+
+func TestLabelPluginArgs(t *testing.T) {
+	labels := map[string]string{
+		CNIArgsLabelPrefix + "Zone":     "a",
+		CNIArgsLabelPrefix + "IPPool":   "blue",
+		CNIArgsLabelPrefix + "Bad":      "x;y",
+		CNIArgsLabelPrefix:              "empty",
+		"io.rancher.container.uuid":     "uuid",
+		"io.rancher.cni.args":           "nope",
+		CNIArgsLabelPrefix + "Key=Fake": "v",
+	}
+
+	expected := [][2]string{{"IPPool", "blue"}, {"Zone", "a"}}
+	if actual := labelPluginArgs(labels); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestCapabilityArgs(t *testing.T) {
+	state := &glue.DockerPluginState{
+		Config: container.Config{
+			Labels: map[string]string{
+				CapabilityArgsLabelPrefix + "ipRanges": `[[{"subnet": "10.42.0.0/16"}]]`,
+			},
+		},
+		HostConfig: container.HostConfig{
+			PortBindings: nat.PortMap{
+				"80/tcp":  []nat.PortBinding{{HostPort: "8080"}},
+				"53/udp":  []nat.PortBinding{{HostIP: "10.0.0.1", HostPort: ""}},
+				"443/tcp": []nat.PortBinding{},
+			},
+		},
+	}
+
+	args := capabilityArgs(state)
+
+	content, _ := json.Marshal(args)
+	expected := `{"ipRanges":[[{"subnet":"10.42.0.0/16"}]],"portMappings":[{"hostPort":8080,"containerPort":80,"protocol":"tcp"}]}`
+	if string(content) != expected {
+		t.Errorf("expected %s, got %s", expected, content)
+	}
+
+	plugin := map[string]interface{}{
+		"type":         "portmap",
+		"capabilities": map[string]interface{}{"portMappings": true, "ipRanges": false, "bandwidth": true},
+	}
+	if config := runtimeConfig(plugin, args); len(config) != 1 || config["portMappings"] == nil {
+		t.Errorf("expected only portMappings, got %v", config)
+	}
+
+	state.Config.Labels[CapabilityArgsLabelPrefix+"bandwidth"] = "{"
+	if args := capabilityArgs(state); args["bandwidth"] != nil || args["ipRanges"] == nil {
+		t.Errorf("expected only the label with invalid JSON to be skipped, got %v", args)
+	}
+}
@@ -0,0 +1,117 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	arpHeaderLen   = 28
+	etherHeaderLen = 14
+	arpRequest     = 1
+	arpReply       = 2
+)
+
+var (
+	// arpProbeCount and arpProbeWait follow RFC 5227, shortened so that
+	// a container start isn't delayed by more than a second
+	arpProbeCount    = 2
+	arpProbeInterval = 200 * time.Millisecond
+	arpProbeWait     = 500 * time.Millisecond
+)
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
+
+// arpProbe builds an ARP probe frame for ip, with an all zero sender IP so
+// that the neighbours don't update their caches
+func arpProbe(hwAddr net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, etherHeaderLen+arpHeaderLen)
+	copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:12], hwAddr)
+	binary.BigEndian.PutUint16(frame[12:14], syscall.ETH_P_ARP)
+
+	arp := frame[etherHeaderLen:]
+	binary.BigEndian.PutUint16(arp[0:2], 1)
+	binary.BigEndian.PutUint16(arp[2:4], syscall.ETH_P_IP)
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:8], arpRequest)
+	copy(arp[8:14], hwAddr)
+	copy(arp[24:28], ip.To4())
+	return frame
+}
+
+// arpConflict returns the sender MAC of a frame if it claims ip for
+// another interface than hwAddr, nil otherwise
+func arpConflict(frame []byte, hwAddr net.HardwareAddr, ip net.IP) net.HardwareAddr {
+	if len(frame) < etherHeaderLen+arpHeaderLen ||
+		binary.BigEndian.Uint16(frame[12:14]) != syscall.ETH_P_ARP {
+		return nil
+	}
+
+	arp := frame[etherHeaderLen:]
+	op := binary.BigEndian.Uint16(arp[6:8])
+	sha, spa := net.HardwareAddr(arp[8:14]), net.IP(arp[14:18])
+	if (op != arpRequest && op != arpReply) || !spa.Equal(ip.To4()) || bytes.Equal(sha, hwAddr) {
+		return nil
+	}
+	return append(net.HardwareAddr{}, sha...)
+}
+
+// probeIP sends ARP probes for ip on the given interface of the current
+// netns and returns the MAC of whoever answers for it, if anyone does
+// other than the ignored MACs
+func probeIP(ifIndex int, hwAddr net.HardwareAddr, ip net.IP, ignored map[string]bool) (net.HardwareAddr, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return nil, fmt.Errorf("opening ARP socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  ifIndex,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if err := syscall.Bind(fd, addr); err != nil {
+		return nil, fmt.Errorf("binding ARP socket: %v", err)
+	}
+
+	tv := syscall.NsecToTimeval(int64(50 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return nil, fmt.Errorf("setting ARP socket timeout: %v", err)
+	}
+
+	probe := arpProbe(hwAddr, ip)
+	buf := make([]byte, 1500)
+	for i := 0; i < arpProbeCount; i++ {
+		if err := syscall.Sendto(fd, probe, 0, addr); err != nil {
+			return nil, fmt.Errorf("sending ARP probe: %v", err)
+		}
+
+		wait := arpProbeInterval
+		if i == arpProbeCount-1 {
+			wait = arpProbeWait
+		}
+		deadline := time.Now().Add(wait)
+		for time.Now().Before(deadline) {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("reading ARP socket: %v", err)
+			}
+			if mac := arpConflict(buf[:n], hwAddr, ip); mac != nil && !ignored[mac.String()] {
+				return mac, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
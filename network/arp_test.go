@@ -0,0 +1,39 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestARPConflict(t *testing.T) {
+	ours, _ := net.ParseMAC("02:42:0a:2a:00:05")
+	theirs, _ := net.ParseMAC("02:42:0a:2a:00:06")
+	ip := net.ParseIP("10.42.0.5")
+
+	probe := arpProbe(ours, ip)
+	if len(probe) != 42 || binary.BigEndian.Uint16(probe[12:14]) != 0x0806 {
+		t.Fatalf("unexpected probe %x", probe)
+	}
+	if mac := arpConflict(probe, ours, ip); mac != nil {
+		t.Errorf("our own probe isn't a conflict, got %v", mac)
+	}
+
+	// A probe has a zero sender IP, it isn't a claim on the IP
+	if mac := arpConflict(arpProbe(theirs, ip), ours, ip); mac != nil {
+		t.Errorf("another probe isn't a conflict, got %v", mac)
+	}
+
+	reply := arpProbe(theirs, net.ParseIP("10.42.0.1"))
+	binary.BigEndian.PutUint16(reply[20:22], arpReply)
+	copy(reply[28:32], ip.To4())
+	if mac := arpConflict(reply, ours, ip); mac.String() != theirs.String() {
+		t.Errorf("expected a conflict with %v, got %v", theirs, mac)
+	}
+	if mac := arpConflict(reply, ours, net.ParseIP("10.42.0.6")); mac != nil {
+		t.Errorf("a reply for another IP isn't a conflict, got %v", mac)
+	}
+	if mac := arpConflict(reply[:30], ours, ip); mac != nil {
+		t.Errorf("a short frame isn't a conflict, got %v", mac)
+	}
+}
@@ -0,0 +1,178 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/docker/engine-api/types"
+	"github.com/pkg/errors"
+	glue "github.com/rancher/cniglue"
+	"github.com/vishvananda/netlink"
+)
+
+// Attachment is the connection of a container to one of its networks
+type Attachment struct {
+	Network   string                 `json:"network"`
+	IfName    string                 `json:"ifName"`
+	Args      [][2]string            `json:"args,omitempty"`
+	CapArgs   map[string]interface{} `json:"capabilityArgs,omitempty"`
+	Result    *Result                `json:"result,omitempty"`
+	RawResult json.RawMessage        `json:"rawResult,omitempty"`
+}
+
+// containerNetworks returns the networks of a container in interface
+// order, the first one being eth0
+func containerNetworks(inspect *types.ContainerJSON) []string {
+	networks := []string{}
+	for _, name := range strings.Split(inspect.Config.Labels[CNINetworksLabel], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			networks = append(networks, name)
+		}
+	}
+	if len(networks) > 0 {
+		return networks
+	}
+
+	name, ok := inspect.Config.Labels[CNILabel]
+	if !ok && (inspect.Config.Labels[LegacyManagedNetLabel] == "true" || inspect.Config.Labels[IPLabel] != "") {
+		name = "managed"
+	}
+	if name != "" {
+		networks = append(networks, name)
+	}
+
+	return networks
+}
+
+// labelAttachments returns the attachments of a container as described by
+// its labels, for when no results were persisted
+func labelAttachments(inspect *types.ContainerJSON) []*Attachment {
+	attachments := []*Attachment{}
+	for i, network := range containerNetworks(inspect) {
+		attachments = append(attachments, &Attachment{
+			Network: network,
+			IfName:  ifNameForIndex(i),
+		})
+	}
+	return attachments
+}
+
+func ifNameForIndex(i int) string {
+	return fmt.Sprintf("eth%d", i)
+}
+
+// attach runs ADD for every network of the container. If one of them
+// fails, the networks attached so far are detached again.
+func attach(pluginState *glue.DockerPluginState, networks []string) ([]*Attachment, error) {
+	attachments := []*Attachment{}
+	for i, network := range networks {
+		a := &Attachment{
+			Network: network,
+			IfName:  ifNameForIndex(i),
+		}
+
+		c, err := newCNIExec(pluginState, a.Network, a.IfName)
+		if err == nil && c == nil {
+			return nil, nil
+		}
+		if err == nil {
+			a.Args = c.args.PluginArgs
+			a.CapArgs = c.capabilityArgs
+			a.Result, a.RawResult, err = c.Add()
+		}
+		if err == nil && a.Result == nil {
+			err = fmt.Errorf("no result")
+		}
+		if err == nil && i > 0 {
+			err = setInterfaceRoutes(pluginState.Pid, a)
+		}
+		if err != nil {
+			if detachErr := detach(pluginState, attachments); detachErr != nil {
+				logrus.WithField("cid", pluginState.ContainerID).Warnf("Failed to detach networks after failure: %v", detachErr)
+			}
+			return nil, errors.Wrapf(err, "attaching network %s", network)
+		}
+
+		attachments = append(attachments, a)
+	}
+
+	return attachments, nil
+}
+
+// detach runs DEL for the given attachments in reverse order. The CNI
+// args and capability args stored on ADD are used, if any, as the labels
+// may be gone.
+func detach(pluginState *glue.DockerPluginState, attachments []*Attachment) error {
+	var lastErr error
+	for i := len(attachments) - 1; i >= 0; i-- {
+		a := attachments[i]
+		c, err := newCNIExec(pluginState, a.Network, a.IfName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if c == nil {
+			continue
+		}
+		if len(a.Args) > 0 {
+			c.args.PluginArgs = a.Args
+		}
+		if len(a.CapArgs) > 0 {
+			c.capabilityArgs = a.CapArgs
+		}
+		if err := c.Del(a.RawResult); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// setInterfaceRoutes adds the routes of a secondary network through its
+// own interface. Default routes are left to eth0.
+func setInterfaceRoutes(pid int, a *Attachment) error {
+	if len(a.Result.Routes) == 0 {
+		return nil
+	}
+
+	netns, err := ns.GetNS(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		l, err := netlink.LinkByName(a.IfName)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range a.Result.Routes {
+			_, dst, err := net.ParseCIDR(r.Dst)
+			if err != nil {
+				return errors.Wrapf(err, "parsing route %s", r.Dst)
+			}
+			if ones, _ := dst.Mask.Size(); ones == 0 {
+				continue
+			}
+
+			route := &netlink.Route{
+				LinkIndex: l.Attrs().Index,
+				Dst:       dst,
+				Gw:        net.ParseIP(r.GW),
+			}
+			if route.Gw == nil {
+				route.Scope = netlink.SCOPE_LINK
+			}
+			if err := netlink.RouteAdd(route); err != nil && !os.IsExist(err) {
+				return errors.Wrapf(err, "adding route %s on %s", r.Dst, a.IfName)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,27 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+)
+
+func TestContainerNetworks(t *testing.T) {
+	for _, c := range []struct {
+		labels   map[string]string
+		expected []string
+	}{
+		{map[string]string{}, []string{}},
+		{map[string]string{CNILabel: "managed"}, []string{"managed"}},
+		{map[string]string{IPLabel: "10.42.0.5"}, []string{"managed"}},
+		{map[string]string{LegacyManagedNetLabel: "true"}, []string{"managed"}},
+		{map[string]string{CNINetworksLabel: "managed, storage,", CNILabel: "other"}, []string{"managed", "storage"}},
+	} {
+		inspect := &types.ContainerJSON{Config: &container.Config{Labels: c.labels}}
+		if actual := containerNetworks(inspect); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("labels %v: expected %v, got %v", c.labels, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package network
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/docker/engine-api/types"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// IngressRateLabel limits the traffic to the container, e.g. 10mbit
+	IngressRateLabel = "io.rancher.network.ingress_rate"
+	// EgressRateLabel limits the traffic from the container, e.g. 10mbit
+	EgressRateLabel = "io.rancher.network.egress_rate"
+	// BurstLabel sets the size of the token bucket, e.g. 64kb
+	BurstLabel = "io.rancher.network.burst"
+
+	hostVethPrefix = "vethr"
+	// tbfLatencyUsec is the maximum time a packet can wait in the bucket
+	tbfLatencyUsec = 25000
+	minBurst       = 32 * 1024
+)
+
+var (
+	quantityRegexp   = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([kmgt]?)(bit|bps|b)?$`)
+	quantityPrefixes = map[string]float64{"": 1, "k": 1e3, "m": 1e6, "g": 1e9, "t": 1e12}
+)
+
+// bandwidth is a token bucket, the rate in bits per second and the burst
+// in bytes
+type bandwidth struct {
+	Rate  uint64
+	Burst uint64
+}
+
+// parseQuantity parses a tc like quantity, "bit" units are bits, "bps" and
+// "b" units are bytes. A bare number uses the given default unit.
+func parseQuantity(value, defaultUnit string) (float64, string, error) {
+	m := quantityRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(value)))
+	if m == nil {
+		return 0, "", fmt.Errorf("invalid quantity %q", value)
+	}
+
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid quantity %q: %v", value, err)
+	}
+	n *= quantityPrefixes[m[2]]
+
+	unit := m[3]
+	if unit == "" {
+		unit = defaultUnit
+	}
+	return n, unit, nil
+}
+
+// parseRate returns a rate in bits per second, bits by default
+func parseRate(value string) (uint64, error) {
+	n, unit, err := parseQuantity(value, "bit")
+	if err != nil {
+		return 0, err
+	}
+	if unit != "bit" {
+		n *= 8
+	}
+	if n < 8 || n/8 > math.MaxUint32 {
+		return 0, fmt.Errorf("rate %q out of range", value)
+	}
+	return uint64(n), nil
+}
+
+// parseBurst returns a size in bytes, bytes by default
+func parseBurst(value string) (uint64, error) {
+	n, unit, err := parseQuantity(value, "b")
+	if err != nil {
+		return 0, err
+	}
+	if unit == "bit" {
+		n /= 8
+	}
+	if n < 1 || n > math.MaxUint32 {
+		return 0, fmt.Errorf("burst %q out of range", value)
+	}
+	return uint64(n), nil
+}
+
+// bandwidthLimits returns the ingress and egress limits asked for by the
+// labels of a container, nil when there is none
+func bandwidthLimits(labels map[string]string) (*bandwidth, *bandwidth, error) {
+	var burst uint64
+	if value := labels[BurstLabel]; value != "" {
+		b, err := parseBurst(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		burst = b
+	}
+
+	limit := func(label string) (*bandwidth, error) {
+		value := labels[label]
+		if value == "" {
+			return nil, nil
+		}
+		rate, err := parseRate(value)
+		if err != nil {
+			return nil, err
+		}
+		b := burst
+		if b == 0 {
+			// 10ms worth of traffic
+			b = rate / 8 / 100
+			if b < minBurst {
+				b = minBurst
+			}
+		}
+		return &bandwidth{Rate: rate, Burst: b}, nil
+	}
+
+	ingress, err := limit(IngressRateLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+	egress, err := limit(EgressRateLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ingress, egress, nil
+}
+
+func hostVethName(id string) string {
+	if len(id) > 10 {
+		id = id[:10]
+	}
+	return hostVethPrefix + id
+}
+
+// tbf returns the root qdisc of a link shaping its outgoing traffic
+func tbf(linkIndex int, bw *bandwidth) *netlink.Tbf {
+	rate := bw.Rate / 8
+	buffer := uint32(netlink.Xmittime(rate, uint32(bw.Burst)))
+	limit := uint32(float64(rate)*tbfLatencyUsec/netlink.TIME_UNITS_PER_SEC) + uint32(bw.Burst)
+
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rate,
+		Limit:  limit,
+		Buffer: buffer,
+	}
+}
+
+// shapeLink sets the tbf qdisc of a link in the current netns, unless it's
+// already there
+func shapeLink(ifName string, bw *bandwidth) error {
+	l, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("interface %s not found: %v", ifName, err)
+	}
+
+	desired := tbf(l.Attrs().Index, bw)
+	qdiscs, err := netlink.QdiscList(l)
+	if err != nil {
+		return fmt.Errorf("listing qdiscs of %s: %v", ifName, err)
+	}
+	for _, q := range qdiscs {
+		if t, ok := q.(*netlink.Tbf); ok && t.Parent == netlink.HANDLE_ROOT &&
+			t.Rate == desired.Rate && t.Limit == desired.Limit && t.Buffer == desired.Buffer {
+			return nil
+		}
+	}
+
+	if err := netlink.QdiscReplace(desired); err != nil {
+		return fmt.Errorf("setting tbf qdisc on %s: %v", ifName, err)
+	}
+	logrus.WithFields(logrus.Fields{"ifName": ifName, "rate": bw.Rate, "burst": bw.Burst}).Infof("Shaped interface")
+	return nil
+}
+
+// applyBandwidth shapes the traffic to a container on its host side veth
+// and the traffic from it on its eth0, as asked by its labels
+func (n *Manager) applyBandwidth(inspect types.ContainerJSON) error {
+	ingress, egress, err := bandwidthLimits(inspect.Config.Labels)
+	if err != nil {
+		return err
+	}
+
+	if ingress != nil {
+		if err := shapeLink(hostVethName(inspect.ID), ingress); err != nil {
+			return err
+		}
+	}
+
+	if egress != nil {
+		return EnterNS(n.c, inspect.ID, func(_ ns.NetNS) error {
+			return shapeLink(defaultIfName, egress)
+		})
+	}
+
+	return nil
+}
+
+// removeBandwidth removes the qdisc from the host side veth of a container,
+// if it's still around
+func removeBandwidth(id string) error {
+	l, err := netlink.LinkByName(hostVethName(id))
+	if err != nil {
+		return nil
+	}
+
+	qdiscs, err := netlink.QdiscList(l)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		if t, ok := q.(*netlink.Tbf); ok && t.Parent == netlink.HANDLE_ROOT {
+			return netlink.QdiscDel(t)
+		}
+	}
+	return nil
+}
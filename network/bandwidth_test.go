@@ -0,0 +1,72 @@
+package network
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	for _, c := range []struct {
+		value    string
+		expected uint64
+		valid    bool
+	}{
+		{"10mbit", 10000000, true},
+		{"1.5Gbit", 1500000000, true},
+		{"500kbps", 4000000, true},
+		{"800", 800, true},
+		{"1mb", 8000000, true},
+		{"", 0, false},
+		{"fast", 0, false},
+		{"0", 0, false},
+		{"1000gbps", 0, false},
+	} {
+		actual, err := parseRate(c.value)
+		if (err == nil) != c.valid || actual != c.expected {
+			t.Errorf("%q: expected %v (valid: %v), got %v, %v", c.value, c.expected, c.valid, actual, err)
+		}
+	}
+}
+
+func TestParseBurst(t *testing.T) {
+	for _, c := range []struct {
+		value    string
+		expected uint64
+		valid    bool
+	}{
+		{"64kb", 64000, true},
+		{"1500", 1500, true},
+		{"80kbit", 10000, true},
+		{"-1", 0, false},
+	} {
+		actual, err := parseBurst(c.value)
+		if (err == nil) != c.valid || actual != c.expected {
+			t.Errorf("%q: expected %v (valid: %v), got %v, %v", c.value, c.expected, c.valid, actual, err)
+		}
+	}
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	ingress, egress, err := bandwidthLimits(map[string]string{
+		IngressRateLabel: "1gbit",
+		EgressRateLabel:  "1mbit",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ingress == nil || ingress.Rate != 1000000000 || ingress.Burst != 1250000 {
+		t.Errorf("unexpected ingress %+v", ingress)
+	}
+	if egress == nil || egress.Rate != 1000000 || egress.Burst != minBurst {
+		t.Errorf("unexpected egress %+v", egress)
+	}
+
+	ingress, egress, err = bandwidthLimits(map[string]string{
+		EgressRateLabel: "1mbit",
+		BurstLabel:      "10kb",
+	})
+	if err != nil || ingress != nil || egress == nil || egress.Burst != 10000 {
+		t.Errorf("unexpected limits %+v, %+v, %v", ingress, egress, err)
+	}
+
+	if _, _, err := bandwidthLimits(map[string]string{BurstLabel: "lots"}); err == nil {
+		t.Errorf("expected an error for an invalid burst")
+	}
+}
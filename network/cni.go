@@ -0,0 +1,297 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/pkg/errors"
+	glue "github.com/rancher/cniglue"
+	"github.com/rancher/plugin-manager/utils"
+)
+
+// cniNetwork is the CNI configuration of a network as found in its
+// config directory. A network with a .conflist is run as a chain, every
+// plugin gets the result of the previous one as prevResult, the plugins
+// of the .conf files next to it are part of the chain in file name order.
+// Plain .conf files alone are run one after the other, as cniglue always
+// did.
+type cniNetwork struct {
+	Name       string
+	CNIVersion string
+	Chained    bool
+	Plugins    []map[string]interface{}
+}
+
+type cniConfList struct {
+	Name       string                   `json:"name"`
+	CNIVersion string                   `json:"cniVersion"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+// cniExec runs the plugins of a network for a container
+type cniExec struct {
+	network        *cniNetwork
+	pid            int
+	args           invoke.Args
+	capabilityArgs map[string]interface{}
+}
+
+func loadCNINetwork(name string) (*cniNetwork, error) {
+	dir := fmt.Sprintf(glue.CniDir, name)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		switch filepath.Ext(f.Name()) {
+		case ".conflist", ".conf", ".json":
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("couldn't find any CNI network configurations in %s", dir)
+	}
+
+	network := &cniNetwork{}
+	for _, fileName := range names {
+		file := filepath.Join(dir, fileName)
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if filepath.Ext(fileName) != ".conflist" {
+			conf := map[string]interface{}{}
+			if err := json.Unmarshal(content, &conf); err != nil {
+				return nil, errors.Wrapf(err, "parsing %s", file)
+			}
+			network.Plugins = append(network.Plugins, conf)
+			continue
+		}
+
+		confList := &cniConfList{}
+		if err := json.Unmarshal(content, confList); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", file)
+		}
+		if len(confList.Plugins) == 0 {
+			return nil, fmt.Errorf("no plugins in %s", file)
+		}
+		if !network.Chained {
+			network.Name, network.CNIVersion, network.Chained = confList.Name, confList.CNIVersion, true
+		}
+		network.Plugins = append(network.Plugins, confList.Plugins...)
+	}
+
+	if !network.Chained {
+		network.Name, _ = network.Plugins[0]["name"].(string)
+		network.CNIVersion, _ = network.Plugins[0]["cniVersion"].(string)
+	}
+
+	return network, nil
+}
+
+func newCNIExec(state *glue.DockerPluginState, name, ifName string) (*cniExec, error) {
+	if state.HostConfig.NetworkMode.IsContainer() ||
+		state.HostConfig.NetworkMode.IsHost() ||
+		state.HostConfig.NetworkMode.IsNone() {
+		return nil, nil
+	}
+
+	if name == "" {
+		name = "default"
+	}
+
+	network, err := loadCNINetwork(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cniExec{
+		network: network,
+		pid:     state.Pid,
+		args: invoke.Args{
+			ContainerID: state.ContainerID,
+			NetNS:       fmt.Sprintf("/proc/%d/ns/net", state.Pid),
+			IfName:      ifName,
+			Path:        strings.Join(glue.CniPath, ":"),
+			PluginArgs: [][2]string{
+				{"IgnoreUnknown", "1"},
+				{"DOCKER", "true"},
+			},
+		},
+	}
+
+	for _, labelArg := range [][2]string{
+		{"io.rancher.container.uuid", "RancherContainerUUID"},
+		{"io.rancher.cni.link_mtu_overhead", "LinkMTUOverhead"},
+		{"io.rancher.container.mac_address", "MACAddress"},
+		{IPLabel, "IPAddress"},
+	} {
+		if value, ok := state.Config.Labels[labelArg[0]]; ok {
+			c.args.PluginArgs = append(c.args.PluginArgs, [2]string{labelArg[1], value})
+		}
+	}
+	c.args.PluginArgs = append(c.args.PluginArgs, labelPluginArgs(state.Config.Labels)...)
+
+	c.capabilityArgs = capabilityArgs(state)
+
+	os.Setenv("PATH", strings.Join(glue.CniPath, ":"))
+
+	return c, nil
+}
+
+func (c *cniExec) pluginConf(plugin map[string]interface{}, prevResult []byte) ([]byte, error) {
+	conf := map[string]interface{}{}
+	for k, v := range plugin {
+		conf[k] = v
+	}
+
+	if config := runtimeConfig(plugin, c.capabilityArgs); len(config) > 0 {
+		conf["runtimeConfig"] = config
+	}
+
+	if c.network.Chained {
+		conf["name"] = c.network.Name
+		conf["cniVersion"] = c.network.CNIVersion
+		if prevResult != nil && versionAtLeast(c.network.CNIVersion, "0.3.0") {
+			// A pointer, json.RawMessage only has a MarshalJSON with a
+			// pointer receiver before go1.8
+			raw := json.RawMessage(prevResult)
+			conf["prevResult"] = &raw
+		}
+	}
+
+	return json.Marshal(conf)
+}
+
+func (c *cniExec) exec(command string, plugin map[string]interface{}, prevResult []byte) ([]byte, error) {
+	pluginType, _ := plugin["type"].(string)
+	pluginPath, err := invoke.FindInPath(pluginType, glue.CniPath)
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := c.pluginConf(plugin, prevResult)
+	if err != nil {
+		return nil, err
+	}
+
+	args := c.args
+	args.Command = command
+	if command == "DEL" {
+		args.NetNS = c.delNetNS()
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"command": command,
+		"plugin":  pluginType,
+		"cid":     c.args.ContainerID,
+		"ifName":  c.args.IfName,
+	}).Debugf("Executing CNI plugin")
+
+	raw := &invoke.RawExec{Stderr: os.Stderr}
+	return raw.ExecPlugin(pluginPath, conf, args.AsEnv())
+}
+
+// validate checks the plugins of the network before running any of them,
+// so that a bad config doesn't leave a container half set up
+func (c *cniNetwork) validate() error {
+	for _, plugin := range c.Plugins {
+		if err := utils.ValidateCNIPlugin(plugin, glue.CniPath); err != nil {
+			return errors.Wrapf(err, "invalid CNI config for network %s", c.Name)
+		}
+	}
+	return nil
+}
+
+// Add runs ADD for the network and returns the parsed result along with
+// the raw result in the network's CNI version
+func (c *cniExec) Add() (*Result, []byte, error) {
+	if err := c.network.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	var result *Result
+	var rawResult []byte
+	for _, plugin := range c.network.Plugins {
+		out, err := c.exec("ADD", plugin, rawResult)
+		if err != nil {
+			if c.network.Chained {
+				c.Del(rawResult)
+			}
+			return nil, nil, err
+		}
+
+		pluginResult, err := parseResult(out)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "parsing CNI result")
+		}
+
+		if c.network.Chained || len(pluginResult.IPs) > 0 {
+			result, rawResult = pluginResult, out
+		}
+	}
+
+	return result, rawResult, nil
+}
+
+// delNetNS returns the netns passed to DEL. It's the one of the container
+// while its process is alive, e.g. for a repair, so that the plugins can
+// remove the interfaces. It's empty once the container is gone.
+func (c *cniExec) delNetNS() string {
+	if c.pid == 0 {
+		return ""
+	}
+	if _, err := os.Stat(c.args.NetNS); err != nil {
+		return ""
+	}
+	return c.args.NetNS
+}
+
+// Del runs DEL for the network in reverse order, prevResult is passed to
+// chained plugins when known
+func (c *cniExec) Del(prevResult []byte) error {
+	var lastErr error
+	for i := len(c.network.Plugins) - 1; i >= 0; i-- {
+		if _, err := c.exec("DEL", c.network.Plugins[i], prevResult); err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// SupportsCheck tells if the plugins of the network implement CHECK
+func (c *cniExec) SupportsCheck() bool {
+	return c.network.Chained && versionAtLeast(c.network.CNIVersion, "0.4.0")
+}
+
+// Check runs CHECK for every plugin of the network with the result
+// stored on ADD
+func (c *cniExec) Check(prevResult []byte) error {
+	if !c.SupportsCheck() {
+		return nil
+	}
+
+	for _, plugin := range c.network.Plugins {
+		if _, err := c.exec("CHECK", plugin, prevResult); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	glue "github.com/rancher/cniglue"
+)
+
+func TestLoadCNINetworkMixed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	old := glue.CniDir
+	glue.CniDir = filepath.Join(dir, "%s.d")
+	defer func() { glue.CniDir = old }()
+
+	confDir := filepath.Join(dir, "managed.d")
+	os.MkdirAll(confDir, 0755)
+	for name, content := range map[string]string{
+		"10-managed.conflist": `{"name": "managed", "cniVersion": "0.3.1", "plugins": [{"type": "rancher-bridge"}, {"type": "portmap"}]}`,
+		"20-bandwidth.conf":   `{"name": "other", "cniVersion": "0.2.0", "type": "bandwidth"}`,
+		"05-tuning.conf":      `{"type": "tuning"}`,
+		"README":              `not a config`,
+	} {
+		ioutil.WriteFile(filepath.Join(confDir, name), []byte(content), 0644)
+	}
+
+	network, err := loadCNINetwork("managed")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !network.Chained || network.Name != "managed" || network.CNIVersion != "0.3.1" {
+		t.Errorf("unexpected network %+v", network)
+	}
+	types := []string{}
+	for _, plugin := range network.Plugins {
+		types = append(types, plugin["type"].(string))
+	}
+	if expected := []string{"tuning", "rancher-bridge", "portmap", "bandwidth"}; !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected plugins %v, got %v", expected, types)
+	}
+}
+
+func TestPluginConfPrevResult(t *testing.T) {
+	c := &cniExec{network: &cniNetwork{Name: "managed", CNIVersion: "0.3.1", Chained: true}}
+	out, err := c.pluginConf(map[string]interface{}{"type": "portmap"}, []byte(`{"cniVersion": "0.3.1", "ips": []}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	conf := struct {
+		PrevResult map[string]interface{} `json:"prevResult"`
+	}{}
+	if err := json.Unmarshal(out, &conf); err != nil || conf.PrevResult["cniVersion"] != "0.3.1" {
+		t.Errorf("expected prevResult to be embedded as JSON, got %s, %v", out, err)
+	}
+}
+
+// setupRecorder sets up the managed network with a plugin recording the
+// command and netns it's run with, ADD fails. It returns the log file.
+func setupRecorder(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cni")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	oldDir, oldPath, oldEnv := glue.CniDir, glue.CniPath, os.Getenv("PATH")
+	glue.CniDir = filepath.Join(dir, "%s.d")
+	glue.CniPath = []string{dir}
+
+	os.MkdirAll(filepath.Join(dir, "managed.d"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "managed.d", "10-managed.conf"),
+		[]byte(`{"name": "managed", "cniVersion": "0.3.1", "type": "recorder"}`), 0644)
+	log := filepath.Join(dir, "recorder.log")
+	ioutil.WriteFile(filepath.Join(dir, "recorder"), []byte(fmt.Sprintf(`#!/bin/sh
+echo "$CNI_COMMAND $CNI_NETNS" >> %s
+[ "$CNI_COMMAND" != ADD ]
+`, log)), 0755)
+
+	return log, func() {
+		glue.CniDir, glue.CniPath = oldDir, oldPath
+		os.Setenv("PATH", oldEnv)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRepairDelNetNS(t *testing.T) {
+	log, cleanup := setupRecorder(t)
+	defer cleanup()
+
+	inspect := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         "abc",
+			State:      &types.ContainerState{Running: true, Pid: os.Getpid()},
+			HostConfig: &container.HostConfig{},
+		},
+		Config: &container.Config{Labels: map[string]string{CNILabel: "managed"}},
+	}
+	record := &Record{Attachments: []*Attachment{{Network: "managed", IfName: "eth0"}}}
+
+	n := &Manager{dup: &conflicts{disabled: true}}
+	if err := n.redoNetwork(inspect, record); err == nil {
+		t.Fatalf("expected the failing ADD to be reported")
+	}
+
+	content, _ := ioutil.ReadFile(log)
+	netns := fmt.Sprintf("/proc/%d/ns/net", os.Getpid())
+	if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) < 2 || lines[0] != "DEL "+netns || lines[1] != "ADD "+netns {
+		t.Errorf("expected DEL then ADD in the netns of the running container, got %q", content)
+	}
+}
+
+func TestDetachStoppedNetNS(t *testing.T) {
+	log, cleanup := setupRecorder(t)
+	defer cleanup()
+
+	if err := detach(&glue.DockerPluginState{ContainerID: "abc"}, []*Attachment{{Network: "managed", IfName: "eth0"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(log); strings.TrimSpace(string(content)) != "DEL" {
+		t.Errorf("expected DEL without netns once the container is gone, got %q", content)
+	}
+}
+
+func TestCollectPending(t *testing.T) {
+	log, cleanup := setupRecorder(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := &Manager{s: &state{store: NewStore(dir), startTimes: map[string]string{}, ips: map[string]string{}}}
+	n.s.recordNetworkUpFailure("abc", "2017-01-01T00:00:00Z", []*Attachment{{Network: "managed", IfName: "eth0"}}, 3, fmt.Errorf("ADD failed"))
+
+	result := n.collect("abc", false)
+	if !result.Removed || !reflect.DeepEqual(result.Networks, []string{"managed"}) {
+		t.Errorf("expected the pending network to be released, got %+v", result)
+	}
+	if content, _ := ioutil.ReadFile(log); strings.TrimSpace(string(content)) != "DEL" {
+		t.Errorf("expected a DEL for the failed network up, got %q", content)
+	}
+}
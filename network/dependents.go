@@ -0,0 +1,124 @@
+package network
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+)
+
+const (
+	// DependentPolicyLabel tells what to do with a container sharing the
+	// netns of another one when that one's network comes up again
+	DependentPolicyLabel   = "io.rancher.cni.dependent_policy"
+	dependentPolicyRestart = "restart"
+)
+
+// dependents tracks the containers started with --net=container:<parent>,
+// by parent ID
+type dependents struct {
+	sync.Mutex
+	children map[string]map[string]bool
+}
+
+// track records the dependency of a container on the container whose
+// netns it shares
+func (n *Manager) track(inspect types.ContainerJSON) {
+	ref := inspect.HostConfig.NetworkMode.ConnectedContainer()
+	parent, err := n.c.ContainerInspect(context.Background(), ref)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"cid": inspect.ID, "parent": ref}).Debugf("Failed to inspect network parent: %v", err)
+		return
+	}
+
+	n.d.Lock()
+	defer n.d.Unlock()
+	if n.d.children[parent.ID] == nil {
+		n.d.children[parent.ID] = map[string]bool{}
+	}
+	n.d.children[parent.ID][inspect.ID] = true
+}
+
+// forget drops a removed container, both as a dependent and as a parent
+func (n *Manager) forget(id string) {
+	n.d.Lock()
+	defer n.d.Unlock()
+	delete(n.d.children, id)
+	for _, children := range n.d.children {
+		delete(children, id)
+	}
+}
+
+func (n *Manager) dependentsOf(id string) []string {
+	n.d.Lock()
+	defer n.d.Unlock()
+	ids := []string{}
+	for child := range n.d.children[id] {
+		ids = append(ids, child)
+	}
+	return ids
+}
+
+// SetDNSSetup sets the function used to set up DNS for the dependents of
+// a container when its network comes up again
+func (n *Manager) SetDNSSetup(f func(id string) error) {
+	n.d.Lock()
+	defer n.d.Unlock()
+	n.dnsSetup = f
+}
+
+// updateDependents re-runs the DNS and hosts setup of the containers
+// sharing the netns of a container whose network came up again, or
+// restarts them if their policy label asks for it
+func (n *Manager) updateDependents(parent types.ContainerJSON, ip string) {
+	n.d.Lock()
+	dnsSetup := n.dnsSetup
+	n.d.Unlock()
+
+	for _, id := range n.dependentsOf(parent.ID) {
+		inspect, err := n.c.ContainerInspect(context.Background(), id)
+		if client.IsErrContainerNotFound(err) {
+			n.forget(id)
+			continue
+		} else if err != nil {
+			logrus.WithField("cid", id).Errorf("Failed to inspect dependent container: %v", err)
+			continue
+		}
+		if !inspect.State.Running || startedAfter(inspect.State.StartedAt, parent.State.StartedAt) {
+			continue
+		}
+
+		log := logrus.WithFields(logrus.Fields{"cid": id, "parent": parent.ID})
+		if inspect.Config.Labels[DependentPolicyLabel] == dependentPolicyRestart {
+			timeout := stopTimeout
+			if err := n.c.ContainerRestart(context.Background(), id, &timeout); err != nil {
+				log.Errorf("Failed to restart dependent container: %v", err)
+				continue
+			}
+			log.Infof("Restarted dependent container")
+			continue
+		}
+
+		if dnsSetup != nil {
+			if err := dnsSetup(id); err != nil {
+				log.Errorf("Failed to set up DNS of dependent container: %v", err)
+			}
+		}
+		if ip != "" && inspect.Config.Hostname != "" && inspect.HostsPath != "" {
+			if err := n.updateHosts(inspect, ip); err != nil {
+				log.Errorf("Failed to set up hosts of dependent container: %v", err)
+			}
+		}
+		log.Infof("Updated dependent container")
+	}
+}
+
+// startedAfter tells whether start time a is after start time b
+func startedAfter(a, b string) bool {
+	ta, errA := time.Parse(time.RFC3339Nano, a)
+	tb, errB := time.Parse(time.RFC3339Nano, b)
+	return errA == nil && errB == nil && ta.After(tb)
+}
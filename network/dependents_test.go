@@ -0,0 +1,19 @@
+package network
+
+import "testing"
+
+func TestStartedAfter(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		expected bool
+	}{
+		{"2017-03-01T10:00:00.5Z", "2017-03-01T10:00:00.123456789Z", true},
+		{"2017-03-01T10:00:00Z", "2017-03-01T10:00:00.1Z", false},
+		{"2017-03-01T10:00:00Z", "2017-03-01T10:00:00Z", false},
+		{"", "2017-03-01T10:00:00Z", false},
+	} {
+		if actual := startedAfter(c.a, c.b); actual != c.expected {
+			t.Errorf("%s after %s: expected %v, got %v", c.a, c.b, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/docker/engine-api/types"
+	glue "github.com/rancher/cniglue"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	conflictSourceMetadata = "metadata"
+	conflictSourceARPProbe = "arp-probe"
+)
+
+// IPConflict reports an IP found in use by someone else while bringing up
+// the network of a container
+type IPConflict struct {
+	ContainerID string    `json:"containerId"`
+	IP          string    `json:"ip"`
+	Source      string    `json:"source"`
+	Owner       string    `json:"owner"`
+	Time        time.Time `json:"time"`
+}
+
+func (c IPConflict) Error() string {
+	return fmt.Sprintf("duplicate IP %s, already used by %s according to %s", c.IP, c.Owner, c.Source)
+}
+
+type conflicts struct {
+	sync.Mutex
+	disabled bool
+	current  map[string]IPConflict
+}
+
+// SetDuplicateIPCheck enables or disables the duplicate IP detection done
+// before and after bringing up the network of a container
+func (n *Manager) SetDuplicateIPCheck(enabled bool) {
+	n.dup.Lock()
+	defer n.dup.Unlock()
+	n.dup.disabled = !enabled
+}
+
+// IPConflicts returns the containers whose network couldn't be brought
+// up because their IP was in use
+func (n *Manager) IPConflicts() []IPConflict {
+	n.dup.Lock()
+	defer n.dup.Unlock()
+	ret := []IPConflict{}
+	for _, c := range n.dup.current {
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+func (n *Manager) duplicateIPCheck() bool {
+	n.dup.Lock()
+	defer n.dup.Unlock()
+	return !n.dup.disabled
+}
+
+func (n *Manager) raiseConflict(c IPConflict) error {
+	c.Time = time.Now()
+	logrus.WithFields(logrus.Fields{
+		"cid":    c.ContainerID,
+		"ip":     c.IP,
+		"source": c.Source,
+		"owner":  c.Owner,
+	}).Errorf("Duplicate IP detected")
+
+	n.dup.Lock()
+	defer n.dup.Unlock()
+	n.dup.current[c.ContainerID] = c
+	return c
+}
+
+func (n *Manager) clearConflict(id string) {
+	n.dup.Lock()
+	defer n.dup.Unlock()
+	delete(n.dup.current, id)
+}
+
+// attachChecked attaches the networks of a container, making sure that
+// its IP isn't used by another container before and after. The networks
+// are detached again on conflict.
+func (n *Manager) attachChecked(pluginState *glue.DockerPluginState, inspect types.ContainerJSON, networks []string) ([]*Attachment, error) {
+	if !n.duplicateIPCheck() {
+		return attach(pluginState, networks)
+	}
+
+	if ip := inspect.Config.Labels[IPLabel]; ip != "" {
+		if err := n.checkMetadataIP(inspect.ID, ip); err != nil {
+			return nil, err
+		}
+	}
+
+	attachments, err := attach(pluginState, networks)
+	if err != nil || len(attachments) == 0 {
+		return attachments, err
+	}
+
+	if err := n.checkAssignedIP(inspect, attachments[0]); err != nil {
+		if detachErr := detach(pluginState, attachments); detachErr != nil {
+			logrus.WithField("cid", inspect.ID).Warnf("Failed to detach networks after duplicate IP: %v", detachErr)
+		}
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+// checkMetadataIP looks for another running container holding ip on the
+// same network in metadata
+func (n *Manager) checkMetadataIP(id, ip string) error {
+	containers, err := n.mc.GetContainers()
+	if err != nil {
+		logrus.WithField("cid", id).Warnf("Failed to get containers from metadata, skipping duplicate IP check: %v", err)
+		return nil
+	}
+
+	networkUUID := ""
+	for _, aContainer := range containers {
+		if aContainer.ExternalId == id {
+			networkUUID = aContainer.NetworkUUID
+		}
+	}
+
+	for _, aContainer := range containers {
+		if aContainer.ExternalId == id || aContainer.PrimaryIp != ip || aContainer.State != "running" {
+			continue
+		}
+		if networkUUID != "" && aContainer.NetworkUUID != networkUUID {
+			continue
+		}
+		return n.raiseConflict(IPConflict{
+			ContainerID: id,
+			IP:          ip,
+			Source:      conflictSourceMetadata,
+			Owner:       aContainer.Name,
+		})
+	}
+
+	return nil
+}
+
+// checkAssignedIP checks the IP assigned to eth0 against metadata and ARP
+// probes sent from the container's netns. The host ARP table isn't used,
+// it keeps the entry of the previous owner of a reused IP for a while.
+// The MACs of the network routers are ignored, they may answer for the
+// whole subnet.
+func (n *Manager) checkAssignedIP(inspect types.ContainerJSON, a *Attachment) error {
+	addr := a.Result.IPv4(a.IfName)
+	if addr == nil {
+		return nil
+	}
+	ip := addr.IP
+
+	if err := n.checkMetadataIP(inspect.ID, ip.String()); err != nil {
+		return err
+	}
+
+	ignored := map[string]bool{}
+	if _, routers, err := LocalNetworks(n.mc); err == nil {
+		for _, router := range routers {
+			ignored[router.PrimaryMacAddress] = true
+		}
+	}
+
+	var owner net.HardwareAddr
+	err := EnterNS(n.c, inspect.ID, func(_ ns.NetNS) error {
+		l, err := netlink.LinkByName(a.IfName)
+		if err != nil {
+			return err
+		}
+		owner, err = probeIP(l.Attrs().Index, l.Attrs().HardwareAddr, ip, ignored)
+		return err
+	})
+	if err != nil {
+		logrus.WithField("cid", inspect.ID).Warnf("Failed to probe for duplicate IP: %v", err)
+	} else if owner != nil {
+		return n.raiseConflict(IPConflict{
+			ContainerID: inspect.ID,
+			IP:          ip.String(),
+			Source:      conflictSourceARPProbe,
+			Owner:       owner.String(),
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+	glue "github.com/rancher/cniglue"
+)
+
+// GCResult reports what was done with the state of a container that no
+// longer exists
+type GCResult struct {
+	ContainerID string   `json:"containerId"`
+	StartedAt   string   `json:"startedAt,omitempty"`
+	Networks    []string `json:"networks,omitempty"`
+	DryRun      bool     `json:"dryRun,omitempty"`
+	Removed     bool     `json:"removed"`
+	Error       string   `json:"error,omitempty"`
+}
+
+type collector struct {
+	sync.Mutex
+	results []GCResult
+}
+
+// CollectGarbage looks for state dirs of containers that were removed
+// while the agent was down. It runs CNI DEL with the stored results, which
+// releases their IPAM allocations, and removes the dirs. With dryRun set
+// it only reports what it would do.
+func (n *Manager) CollectGarbage(dryRun bool) []GCResult {
+	results, err := n.collectGarbage(dryRun)
+	if err != nil {
+		logrus.Errorf("gc: failed to collect orphaned network state: %v", err)
+	}
+
+	n.gc.Lock()
+	n.gc.results = results
+	n.gc.Unlock()
+
+	return results
+}
+
+// GCStatus returns the results of the last garbage collection
+func (n *Manager) GCStatus() []GCResult {
+	n.gc.Lock()
+	defer n.gc.Unlock()
+	return append([]GCResult{}, n.gc.results...)
+}
+
+func (n *Manager) collectGarbage(dryRun bool) ([]GCResult, error) {
+	containers, err := n.c.ContainerList(context.Background(), types.ContainerListOptions{
+		All: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, aContainer := range containers {
+		known[aContainer.ID] = true
+	}
+
+	ids, err := n.s.store.IDs()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []GCResult{}
+	for _, id := range ids {
+		if known[id] {
+			continue
+		}
+
+		result := n.collect(id, dryRun)
+		logrus.WithFields(logrus.Fields{
+			"cid":      result.ContainerID,
+			"networks": result.Networks,
+			"dryRun":   result.DryRun,
+			"removed":  result.Removed,
+			"error":    result.Error,
+		}).Infof("gc: orphaned network state")
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (n *Manager) collect(id string, dryRun bool) GCResult {
+	result := GCResult{
+		ContainerID: id,
+		DryRun:      dryRun,
+	}
+
+	var attachments []*Attachment
+	if entry, err := n.s.store.Latest(id); err == nil {
+		result.StartedAt = entry.StartedAt
+		attachments = entry.Record.Attachments
+		if len(attachments) == 0 {
+			attachments = entry.Record.Pending
+		}
+		if raw, ok := n.s.store.LegacyResult(id, entry.StartedAt); ok && len(attachments) == 0 {
+			attachments = []*Attachment{legacyAttachment(raw)}
+		}
+		for _, a := range attachments {
+			result.Networks = append(result.Networks, a.Network)
+		}
+	}
+
+	if dryRun {
+		return result
+	}
+
+	pluginState := &glue.DockerPluginState{
+		ContainerID: id,
+	}
+	if err := detach(pluginState, attachments); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	n.s.Stopped(id)
+	result.Removed = true
+	return result
+}
+
+// legacyAttachment returns the attachment of a record written before the
+// networks were persisted, back then cniglue only attached eth0 to the
+// network of the Docker network mode, managed for Rancher containers.
+// cniglue used default for an empty network mode.
+func legacyAttachment(raw json.RawMessage) *Attachment {
+	network := "managed"
+	if _, err := os.Stat(fmt.Sprintf(glue.CniDir, network)); err != nil {
+		network = "default"
+	}
+	return &Attachment{
+		Network:   network,
+		IfName:    defaultIfName,
+		RawResult: raw,
+	}
+}
@@ -0,0 +1,181 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	hostsBlockBegin = "# BEGIN rancher-managed hosts"
+	hostsBlockEnd   = "# END rancher-managed hosts"
+)
+
+type hostsEntry struct {
+	IP    string
+	Names []string
+}
+
+func (h hostsEntry) String() string {
+	return fmt.Sprintf("%s\t%s", h.IP, strings.Join(h.Names, " "))
+}
+
+// hostsEntries builds the entries of the managed block for the given
+// container: its own IP, hostname and FQDN followed by the container links
+// and service aliases found in metadata.
+func hostsEntries(inspect types.ContainerJSON, ip string, containers []metadata.Container, services []metadata.Service) []hostsEntry {
+	names := []string{}
+	if inspect.Config.Domainname != "" {
+		names = append(names, inspect.Config.Hostname+"."+inspect.Config.Domainname)
+	}
+	names = append(names, inspect.Config.Hostname)
+	entries := []hostsEntry{{IP: ip, Names: names}}
+
+	var self *metadata.Container
+	for i, aContainer := range containers {
+		if aContainer.ExternalId == inspect.ID {
+			self = &containers[i]
+			break
+		}
+	}
+	if self == nil {
+		return entries
+	}
+
+	aliases := map[string][]string{}
+	for alias, target := range self.Links {
+		for _, linkIP := range resolveLinkTarget(target, containers) {
+			aliases[linkIP] = append(aliases[linkIP], alias)
+		}
+	}
+
+	for _, service := range services {
+		if service.Name != self.ServiceName || service.StackName != self.StackName {
+			continue
+		}
+		for target, alias := range service.Links {
+			for _, linkIP := range resolveLinkTarget(target, containers) {
+				aliases[linkIP] = append(aliases[linkIP], alias)
+			}
+		}
+	}
+
+	ips := []string{}
+	for linkIP := range aliases {
+		if linkIP != ip {
+			ips = append(ips, linkIP)
+		}
+	}
+	sort.Strings(ips)
+
+	for _, linkIP := range ips {
+		sort.Strings(aliases[linkIP])
+		entries = append(entries, hostsEntry{IP: linkIP, Names: dedup(aliases[linkIP])})
+	}
+
+	return entries
+}
+
+// resolveLinkTarget returns the IPs of the running containers a link
+// points to. The target is either a container UUID, a container name or
+// a "stack/service" reference.
+func resolveLinkTarget(target string, containers []metadata.Container) []string {
+	ips := []string{}
+	stackName, serviceName := "", ""
+	if parts := strings.SplitN(target, "/", 2); len(parts) == 2 {
+		stackName, serviceName = parts[0], parts[1]
+	}
+
+	for _, aContainer := range containers {
+		if aContainer.PrimaryIp == "" || aContainer.State != "running" {
+			continue
+		}
+		if aContainer.UUID == target || aContainer.Name == target ||
+			(serviceName != "" && aContainer.StackName == stackName && aContainer.ServiceName == serviceName) {
+			ips = append(ips, aContainer.PrimaryIp)
+		}
+	}
+
+	return ips
+}
+
+func dedup(values []string) []string {
+	ret := []string{}
+	seen := map[string]bool{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// renderHosts drops the previous managed block, as well as lines appended
+// by older releases for the container hostname, and appends a fresh block
+// built from the given entries.
+func renderHosts(existing string, hostname string, entries []hostsEntry) string {
+	buf := &bytes.Buffer{}
+	inBlock := false
+	scanner := bufio.NewScanner(strings.NewReader(existing))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == hostsBlockBegin:
+			inBlock = true
+			continue
+		case line == hostsBlockEnd:
+			inBlock = false
+			continue
+		case inBlock:
+			continue
+		case isLegacyHostsLine(line, hostname):
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+
+	buf.WriteString(hostsBlockBegin)
+	buf.WriteString("\n")
+	for _, entry := range entries {
+		buf.WriteString(entry.String())
+		buf.WriteString("\n")
+	}
+	buf.WriteString(hostsBlockEnd)
+	buf.WriteString("\n")
+
+	return buf.String()
+}
+
+func isLegacyHostsLine(line, hostname string) bool {
+	fields := strings.Split(line, "\t")
+	return len(fields) == 2 && fields[1] == hostname && !strings.HasPrefix(fields[0], "#")
+}
+
+// writeHosts rewrites the container's hosts file in one write. The file
+// is bind mounted into the container so it can't be replaced with a rename.
+func writeHosts(inspect types.ContainerJSON, entries []hostsEntry) error {
+	hosts, err := ioutil.ReadFile(inspect.HostsPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	updatedHosts := renderHosts(string(hosts), inspect.Config.Hostname, entries)
+	if updatedHosts == string(hosts) {
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{"cid": inspect.ID, "entries": entries}).Debugf("Updating hosts file")
+	return ioutil.WriteFile(inspect.HostsPath, []byte(updatedHosts), 0644)
+}
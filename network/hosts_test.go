@@ -0,0 +1,105 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestRenderHosts(t *testing.T) {
+	existing := "127.0.0.1\tlocalhost\n" +
+		"\n10.42.0.5\tweb\n" +
+		hostsBlockBegin + "\n10.42.0.5\tweb\n10.42.0.9\tdb\n" + hostsBlockEnd + "\n"
+
+	entries := []hostsEntry{
+		{IP: "10.42.0.7", Names: []string{"web"}},
+		{IP: "10.42.0.10", Names: []string{"db"}},
+	}
+
+	expected := "127.0.0.1\tlocalhost\n\n" +
+		hostsBlockBegin + "\n10.42.0.7\tweb\n10.42.0.10\tdb\n" + hostsBlockEnd + "\n"
+
+	actual := renderHosts(existing, "web", entries)
+	if actual != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+
+	if again := renderHosts(actual, "web", entries); again != actual {
+		t.Fatalf("rendering is not stable, got:\n%s", again)
+	}
+}
+
+func TestHostsEntries(t *testing.T) {
+	inspect := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: "abc"},
+		Config: &container.Config{
+			Hostname:   "web",
+			Domainname: "example.com",
+		},
+	}
+	containers := []metadata.Container{
+		{
+			ExternalId:  "abc",
+			Name:        "web-1",
+			ServiceName: "web",
+			StackName:   "app",
+			PrimaryIp:   "10.42.0.7",
+			State:       "running",
+			Links:       map[string]string{"cache": "redis-1"},
+		},
+		{Name: "redis-1", PrimaryIp: "10.42.0.8", State: "running"},
+		{Name: "db-1", ServiceName: "db", StackName: "app", PrimaryIp: "10.42.0.9", State: "running"},
+		{Name: "db-2", ServiceName: "db", StackName: "app", PrimaryIp: "10.42.0.10", State: "stopped"},
+	}
+	services := []metadata.Service{
+		{Name: "web", StackName: "app", Links: map[string]string{"app/db": "database"}},
+	}
+
+	entries := hostsEntries(inspect, "10.42.0.7", containers, services)
+	expected := []string{
+		"10.42.0.7\tweb.example.com web",
+		"10.42.0.8\tcache",
+		"10.42.0.9\tdatabase",
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got: %v", len(expected), entries)
+	}
+	for i, entry := range entries {
+		if entry.String() != expected[i] {
+			t.Errorf("entry %d: expected %q, got %q", i, expected[i], entry.String())
+		}
+	}
+}
+
+func TestRememberIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	result, err := parseResult([]byte(`{"cniVersion": "0.3.1", "interfaces": [{"name": "eth0", "sandbox": "/proc/1/ns/net"}], "ips": [{"version": "4", "interface": 0, "address": "10.42.0.5/16"}]}`))
+	if err != nil {
+		t.Fatalf("parsing result: %v", err)
+	}
+
+	s := &state{store: NewStore(dir), ips: map[string]string{}}
+	s.store.Put("abc", "2017-03-01T08:00:00Z", &Record{Attachments: []*Attachment{{Network: "managed", IfName: "eth0", Result: result}}})
+
+	inspect := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:        "abc",
+			HostsPath: "/var/lib/docker/containers/abc/hosts",
+			State:     &types.ContainerState{StartedAt: "2017-03-01T08:00:00Z"},
+		},
+		Config: &container.Config{Hostname: "web"},
+	}
+	s.rememberIP(inspect)
+	if ip := s.IPs()["abc"]; ip != "10.42.0.5" {
+		t.Errorf("expected the IP of the persisted result, got %q", ip)
+	}
+}
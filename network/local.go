@@ -59,6 +59,12 @@ func LocalNetworks(mc metadata.Client) ([]metadata.Network, map[string]metadata.
 }
 
 func ForEachContainerNS(dc *client.Client, mc metadata.Client, networkUUID string, f func(metadata.Container, ns.NetNS) error) error {
+	return ForEachMatchingContainerNS(dc, mc, networkUUID, nil, f)
+}
+
+// ForEachMatchingContainerNS is ForEachContainerNS limited to the
+// containers accepted by match, the netns of the others isn't entered
+func ForEachMatchingContainerNS(dc *client.Client, mc metadata.Client, networkUUID string, match func(metadata.Container) bool, f func(metadata.Container, ns.NetNS) error) error {
 	host, err := mc.GetSelfHost()
 	if err != nil {
 		return errors.Wrap(err, "error fetching self host from metadata")
@@ -79,6 +85,9 @@ func ForEachContainerNS(dc *client.Client, mc metadata.Client, networkUUID strin
 			aContainer.NetworkUUID == networkUUID) {
 			continue
 		}
+		if match != nil && !match(aContainer) {
+			continue
+		}
 
 		err := EnterNS(dc, aContainer.ExternalId, func(n ns.NetNS) error {
 			return f(aContainer, n)
@@ -2,46 +2,91 @@ package network
 
 import (
 	"context"
-	"fmt"
-	"io/ioutil"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	cniTypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/docker/docker/pkg/locker"
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/container"
 	"github.com/pkg/errors"
 	glue "github.com/rancher/cniglue"
+	"github.com/rancher/go-rancher-metadata/metadata"
 )
 
 const (
-	maxRetries            = 15
 	IPLabel               = "io.rancher.container.ip"
 	LegacyManagedNetLabel = "io.rancher.container.network"
 	CNILabel              = "io.rancher.cni.network"
-	rootStateDir          = "/var/lib/rancher/state/cni"
+	CNINetworksLabel      = "io.rancher.cni.networks"
+	defaultIfName         = "eth0"
 )
 
 type Manager struct {
 	c     *client.Client
+	mc    metadata.Client
 	s     *state
+	r     *reconciler
+	gc    *collector
+	d     *dependents
+	dup   *conflicts
+	retry RetryConfig
 	locks *locker.Locker
+
+	dnsSetup func(id string) error
 }
 
-func NewManager(c *client.Client) (*Manager, error) {
-	s, err := newState(rootStateDir, c)
+func NewManager(c *client.Client, mc metadata.Client, retry RetryConfig) (*Manager, error) {
+	s, err := newState(DefaultStateDir, c)
 	if err != nil {
 		return nil, err
 	}
-	return &Manager{
+	m := &Manager{
 		c:     c,
+		mc:    mc,
 		s:     s,
+		r:     &reconciler{repairs: map[string]*RepairStatus{}},
+		gc:    &collector{},
+		d:     &dependents{children: map[string]map[string]bool{}},
+		dup:   &conflicts{current: map[string]IPConflict{}},
+		retry: retry,
 		locks: locker.New(),
-	}, nil
+	}
+	go mc.OnChange(5, m.onChangeNoError)
+	return m, nil
+}
+
+func (n *Manager) onChangeNoError(version string) {
+	if err := n.refreshHosts(); err != nil {
+		logrus.Errorf("Failed to refresh hosts files: %v", err)
+	}
+}
+
+// Status is the status of the network manager as reported by the
+// status API
+type Status struct {
+	Failures  []FailureStatus         `json:"failures"`
+	Repairs   map[string]RepairStatus `json:"repairs"`
+	GC        []GCResult              `json:"gc"`
+	Conflicts []IPConflict            `json:"conflicts"`
+	Error     string                  `json:"error,omitempty"`
+}
+
+// Status reports the containers whose network couldn't be brought up
+// and the repairs done by the reconciler
+func (n *Manager) Status() Status {
+	ret := Status{
+		Repairs:   n.RepairStatus(),
+		GC:        n.GCStatus(),
+		Conflicts: n.IPConflicts(),
+	}
+	failures, err := n.s.failures()
+	if err != nil {
+		ret.Error = err.Error()
+	}
+	ret.Failures = failures
+	return ret
 }
 
 // Evaluate checks the state and enables networking if needed
@@ -60,11 +105,16 @@ func (n *Manager) evaluate(id string, retryCount int) error {
 
 	inspect, err := n.c.ContainerInspect(context.Background(), id)
 	if client.IsErrContainerNotFound(err) {
+		n.forget(id)
 		running = false
 		time = ""
 	} else if err != nil {
 		return err
 	} else {
+		if inspect.HostConfig != nil && inspect.HostConfig.NetworkMode.IsContainer() {
+			n.track(inspect)
+			return nil
+		}
 		if !configureNetwork(&inspect) {
 			return nil
 		}
@@ -83,6 +133,14 @@ func (n *Manager) evaluate(id string, retryCount int) error {
 	if wasRunning {
 		if running && wasTime != time {
 			return n.networkUp(id, inspect, retryCount)
+		} else if running {
+			if reason := n.s.takePendingRepair(id); reason != nil {
+				record, err := n.s.store.Get(id, time)
+				if err != nil {
+					record = &Record{}
+				}
+				return n.repairLocked(inspect, record, reason)
+			}
 		} else if !running {
 			return n.networkDown(id, inspect)
 		}
@@ -93,8 +151,8 @@ func (n *Manager) evaluate(id string, retryCount int) error {
 	return nil
 }
 
-func (n *Manager) retry(id string, retryCount int) {
-	time.Sleep(2 * time.Second)
+func (n *Manager) retryLater(id string, retryCount int) {
+	time.Sleep(n.retry.ForAttempt(retryCount))
 	logrus.WithFields(logrus.Fields{"cid": id, "count": retryCount}).Infof("Evaluating state from retry")
 	if err := n.evaluate(id, retryCount); err != nil {
 		logrus.Errorf("Failed to evaluate networking: %v", err)
@@ -102,59 +160,140 @@ func (n *Manager) retry(id string, retryCount int) {
 }
 
 func (n *Manager) networkUp(id string, inspect types.ContainerJSON, retryCount int) (err error) {
-	logrus.WithFields(logrus.Fields{"networkMode": inspect.HostConfig.NetworkMode, "cid": inspect.ID}).Infof("CNI up")
+	networks := containerNetworks(&inspect)
+	logrus.WithFields(logrus.Fields{"networks": networks, "cid": inspect.ID}).Infof("CNI up")
 	startedAt := inspect.State.StartedAt
 
+	if retryCount == 0 {
+		if record, err := n.s.store.Get(id, startedAt); err == nil && record.Error != "" {
+			if record.Failed {
+				logrus.WithField("cid", id).Infof("CNI up failed permanently before, not retrying")
+				return nil
+			}
+			logrus.WithFields(logrus.Fields{"cid": id, "count": record.Retries}).Infof("Resuming CNI up retries")
+			retryCount = record.Retries
+		}
+	}
+
 	pluginState, err := glue.LookupPluginState(inspect)
 	if err != nil {
-		return n.s.recordNetworkUpError(id, startedAt, errors.Wrap(err, "Couldn't find plugin state"))
+		return n.s.recordNetworkUpError(id, startedAt, nil, errors.Wrap(err, "Couldn't find plugin state"))
 	}
-	result, err := glue.CNIAdd(pluginState)
-	if err != nil || result == nil {
-		if retryCount < maxRetries {
-			go n.retry(id, retryCount+1)
+	attachments, err := n.attachChecked(pluginState, inspect, networks)
+	if err != nil {
+		if retryCount < n.retry.MaxRetries {
+			n.s.recordNetworkUpRetry(id, startedAt, labelAttachments(&inspect), retryCount+1, err)
+			go n.retryLater(id, retryCount+1)
 			return err
 		}
-		return n.s.recordNetworkUpError(id, startedAt, errors.Wrap(err, "Couldn't bring up network"))
+		err = n.s.recordNetworkUpFailure(id, startedAt, labelAttachments(&inspect), retryCount, errors.Wrap(err, "Couldn't bring up network"))
+		n.applyFailurePolicy(inspect)
+		return err
 	}
-	logrus.WithFields(logrus.Fields{
-		"networkMode": inspect.HostConfig.NetworkMode,
-		"cid":         inspect.ID,
-		"result":      result,
-	}).Infof("CNI up done")
-	if err := n.setupHosts(inspect, result); err != nil {
-		return n.s.recordNetworkUpError(id, startedAt, errors.Wrap(err, "Couldn't setup hosts"))
-	}
-	n.s.Started(id, inspect.State.StartedAt, result)
+	return n.networkUpDone(inspect, attachments)
+}
+
+// networkUpDone records the networks brought up for a container and sets
+// up what depends on them
+func (n *Manager) networkUpDone(inspect types.ContainerJSON, attachments []*Attachment) error {
+	id, startedAt := inspect.ID, inspect.State.StartedAt
+	if attachments == nil {
+		n.s.Started(id, startedAt, nil)
+		return nil
+	}
+	for _, a := range attachments {
+		logrus.WithFields(logrus.Fields{
+			"network":    a.Network,
+			"ifName":     a.IfName,
+			"cid":        inspect.ID,
+			"cniVersion": a.Result.CNIVersion,
+			"result":     a.Result,
+		}).Infof("CNI up done")
+	}
+	if err := n.setupHosts(inspect, attachments[0].Result); err != nil {
+		return n.s.recordNetworkUpError(id, startedAt, attachments, errors.Wrap(err, "Couldn't setup hosts"))
+	}
+	n.s.Started(id, startedAt, attachments)
+	n.clearConflict(id)
+
+	if err := n.applyBandwidth(inspect); err != nil {
+		logrus.WithField("cid", id).Errorf("Failed to apply bandwidth limits: %v", err)
+	}
+
+	ip := ""
+	if addr := attachments[0].Result.IPv4(defaultIfName); addr != nil {
+		ip = addr.IP.String()
+	}
+	go n.updateDependents(inspect, ip)
 	return nil
 }
 
-func (n *Manager) setupHosts(inspect types.ContainerJSON, result *cniTypes.Result) error {
-	if inspect.Config == nil || inspect.Config.Hostname == "" || inspect.HostsPath == "" ||
-		result == nil || result.IP4.IP.String() == "" {
+func (n *Manager) setupHosts(inspect types.ContainerJSON, result *Result) error {
+	if inspect.Config == nil || inspect.Config.Hostname == "" || inspect.HostsPath == "" {
 		return nil
 	}
 
-	hosts, err := ioutil.ReadFile(inspect.HostsPath)
-	ip := strings.SplitN(result.IP4.IP.String(), "/", 2)[0]
-	if os.IsNotExist(err) {
+	addr := result.IPv4(defaultIfName)
+	if addr == nil {
+		return nil
+	}
+
+	ip := addr.IP.String()
+	n.s.SetIP(inspect.ID, ip)
+	return n.updateHosts(inspect, ip)
+}
+
+func (n *Manager) updateHosts(inspect types.ContainerJSON, ip string) error {
+	containers, err := n.mc.GetContainers()
+	if err != nil {
+		logrus.WithField("cid", inspect.ID).Warnf("Failed to fetch containers from metadata for hosts: %v", err)
+	}
+	services, err := n.mc.GetServices()
+	if err != nil {
+		logrus.WithField("cid", inspect.ID).Warnf("Failed to fetch services from metadata for hosts: %v", err)
+	}
+
+	return writeHosts(inspect, hostsEntries(inspect, ip, containers, services))
+}
+
+// refreshHosts rewrites the managed hosts block of every container that
+// was networked by this manager, so that links follow IP changes.
+func (n *Manager) refreshHosts() error {
+	var lastErr error
+	for id, ip := range n.s.IPs() {
+		if err := n.refreshContainerHosts(id, ip); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (n *Manager) refreshContainerHosts(id, ip string) error {
+	n.locks.Lock(id)
+	defer n.locks.Unlock(id)
+
+	inspect, err := n.c.ContainerInspect(context.Background(), id)
+	if client.IsErrContainerNotFound(err) {
 		return nil
 	} else if err != nil {
 		return err
 	}
 
-	hostsString := string(hosts)
-	line := fmt.Sprintf("\n%s\t%s\n", ip, inspect.Config.Hostname)
-	if strings.Contains(hostsString, line) {
+	if inspect.Config == nil || inspect.Config.Hostname == "" || inspect.HostsPath == "" ||
+		!inspect.State.Running {
 		return nil
 	}
 
-	updatedHosts := hostsString + line
-	return ioutil.WriteFile(inspect.HostsPath, []byte(updatedHosts), 0644)
+	return n.updateHosts(inspect, ip)
 }
 
 func (n *Manager) networkDown(id string, inspect types.ContainerJSON) error {
+	wasTime := n.s.StartTime(id)
 	defer n.s.Stopped(id)
+	defer n.clearConflict(id)
+	if err := removeBandwidth(id); err != nil {
+		logrus.WithField("cid", id).Warnf("Failed to remove bandwidth limits: %v", err)
+	}
 	if inspect.ContainerJSONBase == nil || inspect.HostConfig == nil {
 		return nil
 	}
@@ -163,19 +302,24 @@ func (n *Manager) networkDown(id string, inspect types.ContainerJSON) error {
 	if err != nil && !os.IsNotExist(err) {
 		return errors.Wrap(err, "Finding plugin state on down")
 	}
-	return glue.CNIDel(pluginState)
-}
 
-func configureNetwork(inspect *types.ContainerJSON) bool {
-	net, ok := inspect.Config.Labels[CNILabel]
-	if !ok && (inspect.Config.Labels[LegacyManagedNetLabel] == "true" || inspect.Config.Labels[IPLabel] != "") {
-		net = "managed"
+	var attachments []*Attachment
+	if record, err := n.s.store.Get(id, wasTime); err == nil {
+		attachments = record.Attachments
+	}
+	if len(attachments) == 0 {
+		attachments = labelAttachments(&inspect)
 	}
 
-	if net == "" {
+	return detach(pluginState, attachments)
+}
+
+func configureNetwork(inspect *types.ContainerJSON) bool {
+	networks := containerNetworks(inspect)
+	if len(networks) == 0 {
 		return false
 	}
 
-	inspect.HostConfig.NetworkMode = container.NetworkMode(net)
+	inspect.HostConfig.NetworkMode = container.NetworkMode(networks[0])
 	return true
 }
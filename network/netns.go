@@ -1,23 +1,61 @@
 package network
 
 import (
+	"fmt"
+	"net"
+
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 )
 
-func (s *state) hasNetwork(pid int) (bool, error) {
+// linkAddrs returns the global unicast addresses of an interface inside
+// the netns of the given pid
+func linkAddrs(pid int, ifName string) ([]*net.IPNet, error) {
 	ns, err := netns.GetFromPid(pid)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer ns.Close()
 
 	handler, err := netlink.NewHandleAt(ns)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer handler.Delete()
 
-	links, err := handler.LinkList()
-	return len(links) > 1, err
+	l, err := handler.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s not found: %v", ifName, err)
+	}
+
+	addrs, err := handler.AddrList(l, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("listing addresses of %s: %v", ifName, err)
+	}
+
+	ret := []*net.IPNet{}
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			ret = append(ret, addr.IPNet)
+		}
+	}
+	return ret, nil
+}
+
+// matchAddrs returns an error if one of the expected addresses is missing
+// from the addresses found on the interface
+func matchAddrs(ifName string, actual, expected []*net.IPNet) error {
+	for _, e := range expected {
+		found := false
+		for _, a := range actual {
+			if a.String() == e.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("address %v missing on %s", e, ifName)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatchAddrs(t *testing.T) {
+	parse := func(cidrs ...string) []*net.IPNet {
+		ret := []*net.IPNet{}
+		for _, cidr := range cidrs {
+			ip, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatalf("parsing %s: %v", cidr, err)
+			}
+			ipNet.IP = ip
+			ret = append(ret, ipNet)
+		}
+		return ret
+	}
+
+	for _, c := range []struct {
+		actual   []*net.IPNet
+		expected []*net.IPNet
+		match    bool
+	}{
+		{parse("10.42.0.5/16"), parse("10.42.0.5/16"), true},
+		{parse("10.42.0.5/16", "fd00::5/64"), parse("10.42.0.5/16"), true},
+		{parse(), parse(), true},
+		{parse("10.42.0.6/16"), parse("10.42.0.5/16"), false},
+		{parse("10.42.0.5/24"), parse("10.42.0.5/16"), false},
+		{parse(), parse("10.42.0.5/16"), false},
+	} {
+		err := matchAddrs("eth0", c.actual, c.expected)
+		if (err == nil) != c.match {
+			t.Errorf("actual %v, expected %v: got %v", c.actual, c.expected, err)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/pkg/errors"
+	glue "github.com/rancher/cniglue"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	// DefaultReconcileInterval specifies the default value for the CNI
+	// reconcile interval in seconds
+	DefaultReconcileInterval = 60
+	// minRepairInterval is the minimum time between two repairs of the
+	// network of the same container
+	minRepairInterval = 5 * time.Minute
+	// maxRepairsPerPass limits the number of repairs done in one pass
+	maxRepairsPerPass = 5
+	// maxRepairFailures is the number of repairs of a container that may
+	// fail in a row before the reconciler gives up on it
+	maxRepairFailures = 5
+)
+
+// RepairStatus reports the repairs done by the reconciler for a container
+type RepairStatus struct {
+	Count      int       `json:"count"`
+	Failures   int       `json:"failures,omitempty"`
+	LastRepair time.Time `json:"lastRepair"`
+	LastReason string    `json:"lastReason"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+type reconciler struct {
+	sync.Mutex
+	repairs map[string]*RepairStatus
+}
+
+// Reconcile starts the go routine that periodically checks that the
+// network of the running containers matches the stored CNI results, and
+// re-runs DEL and ADD when it doesn't.
+func (n *Manager) Reconcile(syncIntervalStr string) {
+	logrus.Debugf("reconcile: syncIntervalStr: %v", syncIntervalStr)
+
+	syncInterval := DefaultReconcileInterval
+	if i, err := strconv.Atoi(syncIntervalStr); err == nil {
+		syncInterval = i
+	}
+
+	go func() {
+		logrus.Infof("reconcile: checking container networks every %v seconds", syncInterval)
+		for {
+			time.Sleep(time.Duration(syncInterval) * time.Second)
+			if err := n.reconcile(); err != nil {
+				logrus.Errorf("reconcile: while checking container networks, got error: %v", err)
+			}
+		}
+	}()
+}
+
+// RepairStatus returns a copy of the repairs done by the reconciler
+func (n *Manager) RepairStatus() map[string]RepairStatus {
+	n.r.Lock()
+	defer n.r.Unlock()
+	ret := map[string]RepairStatus{}
+	for id, status := range n.r.repairs {
+		ret[id] = *status
+	}
+	return ret
+}
+
+func (n *Manager) reconcile() error {
+	containers, err := n.c.ContainerList(context.Background(), types.ContainerListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "listing containers")
+	}
+
+	n.pruneRepairs(containers)
+
+	checked, unhealthy, repaired := 0, 0, 0
+	for _, aContainer := range containers {
+		inspect, err := n.c.ContainerInspect(context.Background(), aContainer.ID)
+		if client.IsErrContainerNotFound(err) {
+			continue
+		} else if err != nil {
+			logrus.Errorf("reconcile: error inspecting container %v: %v", aContainer.ID, err)
+			continue
+		}
+		if !inspect.State.Running || !configureNetwork(&inspect) {
+			continue
+		}
+
+		record, err := n.s.store.Get(inspect.ID, inspect.State.StartedAt)
+		if err != nil || record.primary() == nil {
+			continue
+		}
+
+		checked++
+		reason := n.checkHealth(inspect, record)
+		if reason == nil {
+			if err := n.applyBandwidth(inspect); err != nil {
+				logrus.WithField("cid", inspect.ID).Errorf("reconcile: failed to apply bandwidth limits: %v", err)
+			}
+			continue
+		}
+
+		unhealthy++
+		logrus.WithFields(logrus.Fields{"cid": inspect.ID, "reason": reason}).Warnf("reconcile: container network is unhealthy")
+		if repaired >= maxRepairsPerPass || !n.shouldRepair(inspect.ID) {
+			continue
+		}
+
+		repaired++
+		if err := n.repair(inspect, reason); err != nil {
+			logrus.WithField("cid", inspect.ID).Errorf("reconcile: failed to repair container network: %v", err)
+		}
+	}
+
+	logrus.Debugf("reconcile: checked: %v, unhealthy: %v, repaired: %v", checked, unhealthy, repaired)
+	return nil
+}
+
+// checkHealth uses CNI CHECK when the network supports it, otherwise it
+// compares the interfaces inside the container with the stored results
+func (n *Manager) checkHealth(inspect types.ContainerJSON, record *Record) error {
+	pluginState, err := glue.LookupPluginState(inspect)
+	if err != nil {
+		return nil
+	}
+
+	for _, a := range record.Attachments {
+		c, err := newCNIExec(pluginState, a.Network, a.IfName)
+		if err == nil && c != nil && c.SupportsCheck() {
+			if err := c.Check(a.RawResult); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = EnterNS(n.c, inspect.ID, func(_ ns.NetNS) error {
+			return checkInterface(a.IfName, a.Result.Addresses(a.IfName))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkInterface verifies, inside the current netns, that the interface
+// exists, is up and holds the expected addresses
+func checkInterface(ifName string, expected []*net.IPNet) error {
+	l, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("interface %s not found: %v", ifName, err)
+	}
+
+	if l.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("interface %s is down", ifName)
+	}
+
+	addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("listing addresses of %s: %v", ifName, err)
+	}
+
+	actual := []*net.IPNet{}
+	for _, addr := range addrs {
+		actual = append(actual, addr.IPNet)
+	}
+	return matchAddrs(ifName, actual, expected)
+}
+
+func (n *Manager) pruneRepairs(running []types.Container) {
+	ids := map[string]bool{}
+	for _, aContainer := range running {
+		ids[aContainer.ID] = true
+	}
+
+	n.r.Lock()
+	defer n.r.Unlock()
+	for id := range n.r.repairs {
+		if !ids[id] {
+			delete(n.r.repairs, id)
+		}
+	}
+}
+
+func (n *Manager) shouldRepair(id string) bool {
+	n.r.Lock()
+	defer n.r.Unlock()
+	status, ok := n.r.repairs[id]
+	if ok && status.Failures >= maxRepairFailures {
+		logrus.WithField("cid", id).Debugf("reconcile: giving up on repairing the container network after %v failures", status.Failures)
+		return false
+	}
+	return !ok || time.Now().Sub(status.LastRepair) > minRepairInterval
+}
+
+// repair redoes the network of a container found unhealthy. The container
+// is inspected again under its lock, nothing is done if it was restarted
+// or stopped since it was checked.
+func (n *Manager) repair(checked types.ContainerJSON, reason error) error {
+	n.locks.Lock(checked.ID)
+	defer n.locks.Unlock(checked.ID)
+
+	inspect, err := n.c.ContainerInspect(context.Background(), checked.ID)
+	if client.IsErrContainerNotFound(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "inspecting container")
+	}
+	if !inspect.State.Running || inspect.State.StartedAt != checked.State.StartedAt {
+		logrus.WithField("cid", inspect.ID).Infof("reconcile: container changed since it was checked, not repairing")
+		return nil
+	}
+
+	record, err := n.s.store.Get(inspect.ID, inspect.State.StartedAt)
+	if err != nil || record.primary() == nil {
+		return nil
+	}
+
+	return n.repairLocked(inspect, record, reason)
+}
+
+// repairLocked redoes the network of a container and records the repair,
+// the caller holds the container lock
+func (n *Manager) repairLocked(inspect types.ContainerJSON, record *Record, reason error) error {
+	logrus.WithFields(logrus.Fields{"cid": inspect.ID, "reason": reason}).Infof("reconcile: repairing container network")
+
+	err := n.redoNetwork(inspect, record)
+
+	n.r.Lock()
+	status, ok := n.r.repairs[inspect.ID]
+	if !ok {
+		status = &RepairStatus{}
+		n.r.repairs[inspect.ID] = status
+	}
+	status.Count++
+	status.LastRepair = time.Now()
+	status.LastReason = reason.Error()
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+		status.Failures++
+	} else {
+		status.Failures = 0
+	}
+	n.r.Unlock()
+
+	return err
+}
+
+// redoNetwork runs CNI DEL with the stored results and brings the
+// networks up again. A failure is left to the next repairs, the container
+// was running fine so the network up retries and failure policy don't
+// apply.
+func (n *Manager) redoNetwork(inspect types.ContainerJSON, record *Record) error {
+	pluginState, err := glue.LookupPluginState(inspect)
+	if err != nil {
+		return err
+	}
+	attachments := record.Attachments
+	if len(attachments) == 0 {
+		attachments = labelAttachments(&inspect)
+	}
+	if err := detach(pluginState, attachments); err != nil {
+		logrus.WithField("cid", inspect.ID).Warnf("reconcile: CNI del failed, continuing: %v", err)
+	}
+
+	attachments, err = n.attachChecked(pluginState, inspect, containerNetworks(&inspect))
+	if err != nil {
+		return errors.Wrap(err, "Couldn't bring up network")
+	}
+	return n.networkUpDone(inspect, attachments)
+}
@@ -0,0 +1,25 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShouldRepair(t *testing.T) {
+	n := &Manager{r: &reconciler{repairs: map[string]*RepairStatus{
+		"recent":  {LastRepair: time.Now()},
+		"old":     {LastRepair: time.Now().Add(-2 * minRepairInterval), Failures: maxRepairFailures - 1},
+		"failing": {LastRepair: time.Now().Add(-2 * minRepairInterval), Failures: maxRepairFailures},
+	}}}
+
+	for id, expected := range map[string]bool{
+		"new":     true,
+		"recent":  false,
+		"old":     true,
+		"failing": false,
+	} {
+		if actual := n.shouldRepair(id); actual != expected {
+			t.Errorf("%s: expected %v, got %v", id, expected, actual)
+		}
+	}
+}
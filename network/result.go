@@ -0,0 +1,143 @@
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+)
+
+// Result is a CNI result in the 0.3.x/0.4.x format. Results returned by
+// older plugins (ip4/ip6) are converted when parsed.
+type Result struct {
+	CNIVersion string       `json:"cniVersion,omitempty"`
+	Interfaces []*Interface `json:"interfaces,omitempty"`
+	IPs        []*IPConfig  `json:"ips,omitempty"`
+	Routes     []*Route     `json:"routes,omitempty"`
+	DNS        cniTypes.DNS `json:"dns,omitempty"`
+}
+
+// Interface is an interface created or configured by a plugin
+type Interface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// IPConfig is an address assigned by a plugin, Interface is the index of
+// the interface in the Interfaces list of the result
+type IPConfig struct {
+	Version   string `json:"version"`
+	Interface *int   `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+}
+
+// Route is a route returned by a plugin
+type Route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+type legacyIPConfig struct {
+	IP      string   `json:"ip"`
+	Gateway string   `json:"gateway,omitempty"`
+	Routes  []*Route `json:"routes,omitempty"`
+}
+
+type anyVersionResult struct {
+	Result
+	IP4 *legacyIPConfig `json:"ip4,omitempty"`
+	IP6 *legacyIPConfig `json:"ip6,omitempty"`
+}
+
+func parseResult(data []byte) (*Result, error) {
+	r := &anyVersionResult{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+
+	for i, legacy := range []*legacyIPConfig{r.IP4, r.IP6} {
+		if legacy == nil {
+			continue
+		}
+		r.IPs = append(r.IPs, &IPConfig{
+			Version: []string{"4", "6"}[i],
+			Address: legacy.IP,
+			Gateway: legacy.Gateway,
+		})
+		r.Routes = append(r.Routes, legacy.Routes...)
+	}
+
+	return &r.Result, nil
+}
+
+// Addresses returns the addresses assigned to the given interface inside
+// the container. Addresses which aren't bound to an interface are
+// considered to belong to it.
+func (r *Result) Addresses(ifName string) []*net.IPNet {
+	ret := []*net.IPNet{}
+	if r == nil {
+		return ret
+	}
+
+	for _, ipc := range r.IPs {
+		if ipc.Interface != nil {
+			i := *ipc.Interface
+			if i < 0 || i >= len(r.Interfaces) || r.Interfaces[i].Name != ifName ||
+				r.Interfaces[i].Sandbox == "" {
+				continue
+			}
+		}
+		ip, ipn, err := net.ParseCIDR(ipc.Address)
+		if err != nil {
+			continue
+		}
+		ipn.IP = ip
+		ret = append(ret, ipn)
+	}
+
+	return ret
+}
+
+// IPv4 returns the first IPv4 address of the given interface
+func (r *Result) IPv4(ifName string) *net.IPNet {
+	for _, addr := range r.Addresses(ifName) {
+		if addr.IP.To4() != nil {
+			return addr
+		}
+	}
+	return nil
+}
+
+func (r *Result) String() string {
+	addrs := []string{}
+	for _, ipc := range r.IPs {
+		addrs = append(addrs, ipc.Address)
+	}
+	return "[" + strings.Join(addrs, ", ") + "]"
+}
+
+// versionAtLeast compares two CNI spec versions, an empty version is 0.1.0
+func versionAtLeast(version, min string) bool {
+	a, b := splitVersion(version), splitVersion(min)
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return true
+}
+
+func splitVersion(version string) [3]int {
+	ret := [3]int{0, 1, 0}
+	if version == "" {
+		return ret
+	}
+	for i, part := range strings.SplitN(version, ".", 3) {
+		ret[i], _ = strconv.Atoi(part)
+	}
+	return ret
+}
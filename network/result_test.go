@@ -0,0 +1,66 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestParseLegacyResult(t *testing.T) {
+	result, err := parseResult([]byte(`{"ip4": {"ip": "10.42.0.5/16", "gateway": "10.42.0.1", "routes": [{"dst": "0.0.0.0/0"}]}}`))
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	addr := result.IPv4("eth0")
+	if addr == nil || addr.String() != "10.42.0.5/16" {
+		t.Fatalf("expected 10.42.0.5/16, got: %v", addr)
+	}
+	if len(result.Routes) != 1 || result.Routes[0].Dst != "0.0.0.0/0" {
+		t.Fatalf("expected the default route, got: %v", result.Routes)
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	result, err := parseResult([]byte(`{
+  "cniVersion": "0.4.0",
+  "interfaces": [
+    {"name": "docker0"},
+    {"name": "vethr1234"},
+    {"name": "eth0", "sandbox": "/proc/42/ns/net"}
+  ],
+  "ips": [
+    {"version": "6", "interface": 2, "address": "fd00::5/64"},
+    {"version": "4", "interface": 2, "address": "10.42.0.5/16", "gateway": "10.42.0.1"},
+    {"version": "4", "interface": 0, "address": "10.42.0.1/16"}
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	if result.CNIVersion != "0.4.0" {
+		t.Errorf("expected version 0.4.0, got: %v", result.CNIVersion)
+	}
+	if addrs := result.Addresses("eth0"); len(addrs) != 2 {
+		t.Errorf("expected 2 addresses on eth0, got: %v", addrs)
+	}
+	if addr := result.IPv4("eth0"); addr == nil || addr.IP.String() != "10.42.0.5" {
+		t.Errorf("expected 10.42.0.5, got: %v", addr)
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	for _, c := range []struct {
+		version, min string
+		expected     bool
+	}{
+		{"", "0.3.0", false},
+		{"0.2.0", "0.3.0", false},
+		{"0.3.1", "0.3.0", true},
+		{"0.4.0", "0.4.0", true},
+		{"1.0.0", "0.4.0", true},
+	} {
+		if actual := versionAtLeast(c.version, c.min); actual != c.expected {
+			t.Errorf("versionAtLeast(%q, %q): expected %v, got %v", c.version, c.min, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package network
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+)
+
+const (
+	FailurePolicyLabel   = "io.rancher.cni.failure_policy"
+	failurePolicyStop    = "stop"
+	failurePolicyRestart = "restart"
+)
+
+var (
+	// DefaultRetryInterval specifies the default value for the first
+	// network up retry interval in seconds
+	DefaultRetryInterval = 2
+	// DefaultRetryMaxInterval specifies the default value for the maximum
+	// network up retry interval in seconds
+	DefaultRetryMaxInterval = 120
+	// DefaultMaxRetries specifies the default number of network up retries
+	DefaultMaxRetries = 15
+	stopTimeout       = 10 * time.Second
+)
+
+// RetryConfig controls how network up failures are retried
+type RetryConfig struct {
+	Min        time.Duration
+	Max        time.Duration
+	Factor     float64
+	Jitter     bool
+	MaxRetries int
+}
+
+// NewRetryConfig builds a RetryConfig from the given flag values, falling
+// back to the defaults for values that are empty or invalid
+func NewRetryConfig(intervalStr, maxIntervalStr, maxRetriesStr string) RetryConfig {
+	interval := DefaultRetryInterval
+	if i, err := strconv.Atoi(intervalStr); err == nil && i > 0 {
+		interval = i
+	}
+
+	maxInterval := DefaultRetryMaxInterval
+	if i, err := strconv.Atoi(maxIntervalStr); err == nil && i > 0 {
+		maxInterval = i
+	}
+
+	maxRetries := DefaultMaxRetries
+	if i, err := strconv.Atoi(maxRetriesStr); err == nil && i >= 0 {
+		maxRetries = i
+	}
+
+	return RetryConfig{
+		Min:        time.Duration(interval) * time.Second,
+		Max:        time.Duration(maxInterval) * time.Second,
+		Factor:     2,
+		Jitter:     true,
+		MaxRetries: maxRetries,
+	}
+}
+
+// ForAttempt returns the delay before the given retry, starting at 1
+func (r RetryConfig) ForAttempt(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	min, max := float64(r.Min), float64(r.Max)
+	if max < min {
+		max = min
+	}
+
+	d := min * math.Pow(r.Factor, float64(attempt-1))
+	if r.Jitter {
+		d = rand.Float64()*(d-min) + min
+	}
+	if d > max {
+		d = max
+	}
+
+	return time.Duration(d)
+}
+
+// applyFailurePolicy stops or restarts a container whose network failed
+// permanently, as asked by its failure policy label
+func (n *Manager) applyFailurePolicy(inspect types.ContainerJSON) {
+	policy := inspect.Config.Labels[FailurePolicyLabel]
+	timeout := stopTimeout
+
+	var err error
+	switch policy {
+	case failurePolicyStop:
+		err = n.c.ContainerStop(context.Background(), inspect.ID, &timeout)
+	case failurePolicyRestart:
+		err = n.c.ContainerRestart(context.Background(), inspect.ID, &timeout)
+	default:
+		return
+	}
+
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"cid": inspect.ID, "policy": policy}).Errorf("Failed to apply network failure policy: %v", err)
+		return
+	}
+	logrus.WithFields(logrus.Fields{"cid": inspect.ID, "policy": policy}).Infof("Applied network failure policy")
+}
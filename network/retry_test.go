@@ -0,0 +1,32 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryForAttempt(t *testing.T) {
+	r := NewRetryConfig("2", "60", "")
+	if r.MaxRetries != DefaultMaxRetries {
+		t.Errorf("expected %v retries, got: %v", DefaultMaxRetries, r.MaxRetries)
+	}
+
+	for attempt := 1; attempt < 20; attempt++ {
+		d := r.ForAttempt(attempt)
+		if d < 2*time.Second || d > 60*time.Second {
+			t.Errorf("attempt %d: delay %v out of bounds", attempt, d)
+		}
+	}
+
+	r.Jitter = false
+	for attempt, expected := range map[int]time.Duration{
+		1:  2 * time.Second,
+		2:  4 * time.Second,
+		5:  32 * time.Second,
+		10: 60 * time.Second,
+	} {
+		if d := r.ForAttempt(attempt); d != expected {
+			t.Errorf("attempt %d: expected %v, got %v", attempt, expected, d)
+		}
+	}
+}
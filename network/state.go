@@ -2,29 +2,41 @@ package network
 
 import (
 	"context"
-	"encoding/json"
-	"io/ioutil"
-	"os"
-	"path"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 )
 
+// FailureStatus reports a container whose network couldn't be brought
+// up, Failed is set once the retries are exhausted
+type FailureStatus struct {
+	ContainerID string `json:"containerId"`
+	StartedAt   string `json:"startedAt"`
+	Error       string `json:"error"`
+	Retries     int    `json:"retries"`
+	Failed      bool   `json:"failed"`
+}
+
 type state struct {
 	sync.RWMutex
-	rootStateDir string
-	startTimes   map[string]string
-	c            *client.Client
+	store          *Store
+	startTimes     map[string]string
+	ips            map[string]string
+	pendingRepairs map[string]error
+	c              *client.Client
 }
 
 func newState(rootStateDir string, c *client.Client) (*state, error) {
 	s := &state{
-		startTimes:   map[string]string{},
-		c:            c,
-		rootStateDir: rootStateDir,
+		store:          NewStore(rootStateDir),
+		startTimes:     map[string]string{},
+		ips:            map[string]string{},
+		pendingRepairs: map[string]error{},
+		c:              c,
 	}
 	cs, err := c.ContainerList(context.Background(), types.ContainerListOptions{
 		All: true,
@@ -45,93 +57,229 @@ func newState(rootStateDir string, c *client.Client) (*state, error) {
 			"running":   inspect.State.Running,
 			"startedAt": inspect.State.StartedAt,
 		}).Infof("Inspecting on start")
-		if inspect.State.Running {
-			hasIface, err := s.hasNetwork(inspect.State.Pid)
-			if err != nil {
-				logrus.WithField("cid", inspect.ID).Errorf("Failed to inspect interfaces")
-				continue
-			}
-			if hasIface {
-				logrus.WithFields(logrus.Fields{
-					"cid":       container.ID,
-					"startedAt": inspect.State.StartedAt,
-				}).Info("Recording previously started")
-				s.Started(container.ID, inspect.State.StartedAt, nil)
-			} else {
-				logrus.WithFields(logrus.Fields{
-					"cid": container.ID,
-				}).Info("Still needs networking")
-			}
+		if !inspect.State.Running || !configureNetwork(&inspect) {
+			continue
+		}
+
+		networked, err := s.verify(inspect)
+		switch {
+		case err != nil:
+			logrus.WithFields(logrus.Fields{
+				"cid":    container.ID,
+				"reason": err,
+			}).Warn("Network doesn't match the persisted state, will repair")
+			s.Started(container.ID, inspect.State.StartedAt, nil)
+			s.pendingRepairs[container.ID] = err
+		case networked:
+			logrus.WithFields(logrus.Fields{
+				"cid":       container.ID,
+				"startedAt": inspect.State.StartedAt,
+			}).Info("Recording previously started")
+			s.Started(container.ID, inspect.State.StartedAt, nil)
+			s.rememberIP(inspect)
+		default:
+			logrus.WithFields(logrus.Fields{
+				"cid": container.ID,
+			}).Info("Still needs networking")
 		}
 	}
 
 	return s, nil
 }
 
+// verify tells whether a running container is already networked. When the
+// network of its current start was brought up, the address of eth0 must
+// match the persisted result, otherwise an error explains the mismatch.
+// Without a persisted result, e.g. for containers networked by an older
+// version, an address on eth0 is enough.
+func (s *state) verify(inspect types.ContainerJSON) (bool, error) {
+	record, err := s.store.Get(inspect.ID, inspect.State.StartedAt)
+	if err == nil && record.primary() != nil && record.primary().Result != nil {
+		a := record.primary()
+		addrs, err := linkAddrs(inspect.State.Pid, a.IfName)
+		if err != nil {
+			return false, err
+		}
+		if err := matchAddrs(a.IfName, addrs, a.Result.Addresses(a.IfName)); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	addrs, err := linkAddrs(inspect.State.Pid, defaultIfName)
+	if err != nil {
+		return false, nil
+	}
+	if len(addrs) == 0 {
+		return false, fmt.Errorf("interface %s has no address", defaultIfName)
+	}
+	return true, nil
+}
+
+// rememberIP records the IP of a container networked before the manager
+// started, so that its hosts file is refreshed like the ones of the
+// containers networked since. The persisted result is used when there is
+// one, the address of eth0 otherwise.
+func (s *state) rememberIP(inspect types.ContainerJSON) {
+	if inspect.Config == nil || inspect.Config.Hostname == "" || inspect.HostsPath == "" {
+		return
+	}
+
+	record, err := s.store.Get(inspect.ID, inspect.State.StartedAt)
+	if err == nil && record.primary() != nil && record.primary().Result != nil {
+		if addr := record.primary().Result.IPv4(defaultIfName); addr != nil {
+			s.SetIP(inspect.ID, addr.IP.String())
+			return
+		}
+	}
+
+	addrs, err := linkAddrs(inspect.State.Pid, defaultIfName)
+	if err != nil {
+		logrus.WithField("cid", inspect.ID).Warnf("Failed to find the IP of the container for hosts: %v", err)
+		return
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			s.SetIP(inspect.ID, addr.IP.String())
+			return
+		}
+	}
+}
+
+// takePendingRepair returns and forgets the reason a container was found
+// to need a repair on startup, if any
+func (s *state) takePendingRepair(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	reason := s.pendingRepairs[id]
+	delete(s.pendingRepairs, id)
+	return reason
+}
+
 func (s *state) StartTime(id string) string {
 	s.RLock()
 	defer s.RUnlock()
 	return s.startTimes[id]
 }
 
-func (s *state) Started(id, startedAt string, networkData interface{}) {
+// Started records that the network of a container is up. The attachments,
+// if any, are persisted along with the attempts made so far.
+func (s *state) Started(id, startedAt string, attachments []*Attachment) {
 	s.Lock()
 	s.startTimes[id] = startedAt
 	s.Unlock()
-	if networkData != nil {
-		s.writeState(id, startedAt, networkData)
+	if attachments != nil {
+		s.update(id, startedAt, func(record *Record) {
+			record.Attachments = attachments
+			record.Pending = nil
+			record.Error = ""
+			record.Failed = false
+			record.Attempts = append(record.Attempts, Attempt{Time: time.Now().UTC()})
+		})
 	}
 }
 
-func (s *state) writeState(id, startedAt string, state interface{}) {
-	dir := path.Join(s.rootStateDir, id)
-	filename := path.Join(dir, startedAt)
+func (s *state) SetIP(id, ip string) {
+	s.Lock()
+	defer s.Unlock()
+	s.ips[id] = ip
+}
 
-	data, err := json.Marshal(state)
-	if err != nil {
-		logrus.Warnf("Problem marshaling network data for %v: %v", filename, err)
-		return
+// IPs returns a copy of the IPs assigned to the networked containers
+func (s *state) IPs() map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	ips := map[string]string{}
+	for id, ip := range s.ips {
+		ips[id] = ip
 	}
+	return ips
+}
 
-	if err := os.MkdirAll(dir, 0644); err != nil {
-		logrus.Warnf("Problem creating network state dir for %v: %v", filename, err)
-		return
+// update applies f to the stored record of a container start, starting
+// from an empty record if there is none yet
+func (s *state) update(id, startedAt string, f func(*Record)) {
+	record, err := s.store.Get(id, startedAt)
+	if err != nil {
+		record = &Record{}
 	}
+	f(record)
 
-	f, err := ioutil.TempFile(dir, startedAt)
-	if err != nil {
-		logrus.Warnf("Problem creating network data temp file for %v: %v", filename, err)
-		return
+	if err := s.store.Put(id, startedAt, record); err != nil {
+		logrus.Warnf("Problem writing network state: %v", err)
 	}
+}
 
-	_, err = f.Write(data)
+func (s *state) failures() ([]FailureStatus, error) {
+	entries, err := s.store.List()
 	if err != nil {
-		logrus.Warnf("Problem writing network data to temp file for %v: %v", filename, err)
-		return
+		return nil, err
 	}
-	defer f.Close()
 
-	if err := os.Rename(f.Name(), filename); err != nil {
-		logrus.Warnf("Problem renaming network data file for %v: %v", filename, err)
+	ret := []FailureStatus{}
+	for _, entry := range entries {
+		if entry.Record.Error == "" {
+			continue
+		}
+		ret = append(ret, FailureStatus{
+			ContainerID: entry.ContainerID,
+			StartedAt:   entry.StartedAt,
+			Error:       entry.Record.Error,
+			Retries:     entry.Record.Retries,
+			Failed:      entry.Record.Failed,
+		})
 	}
+
+	return ret, nil
 }
 
 func (s *state) Stopped(id string) {
 	s.Lock()
 	defer s.Unlock()
 	delete(s.startTimes, id)
+	delete(s.ips, id)
 
-	dirName := path.Join(s.rootStateDir, id)
-	if err := os.RemoveAll(dirName); err != nil {
-		logrus.Warnf("Problem cleaning up network state dir %v: %v", dirName, err)
+	if err := s.store.Remove(id); err != nil {
+		logrus.Warnf("Problem cleaning up network state of %v: %v", id, err)
 	}
 }
 
+func (s *state) recordNetworkUpRetry(id, startedAt string, pending []*Attachment, retries int, err error) {
+	s.recordAttempt(id, startedAt, pending, err, func(record *Record) {
+		record.Retries = retries
+	})
+}
+
 // The returned error is the passed in error. It does not represent a problem
-func (s *state) recordNetworkUpError(id, startedAt string, err error) error {
-	errData := map[string]string{
-		"error": err.Error(),
-	}
-	s.writeState(id, startedAt, errData)
+func (s *state) recordNetworkUpFailure(id, startedAt string, pending []*Attachment, retries int, err error) error {
+	s.recordAttempt(id, startedAt, pending, err, func(record *Record) {
+		record.Retries = retries
+		record.Failed = true
+	})
 	return err
 }
+
+// The returned error is the passed in error. It does not represent a problem
+func (s *state) recordNetworkUpError(id, startedAt string, pending []*Attachment, err error) error {
+	s.recordAttempt(id, startedAt, pending, err, nil)
+	return err
+}
+
+// recordAttempt appends a failed attempt to the history of a container
+// start and sets it as the last error. The pending attachments are kept
+// for the gc to release them if the container never gets its network.
+func (s *state) recordAttempt(id, startedAt string, pending []*Attachment, err error, f func(*Record)) {
+	s.update(id, startedAt, func(record *Record) {
+		if pending != nil {
+			record.Pending = pending
+		}
+		record.Error = err.Error()
+		record.Attempts = append(record.Attempts, Attempt{
+			Time:  time.Now().UTC(),
+			Error: err.Error(),
+		})
+		if f != nil {
+			f(record)
+		}
+	})
+}
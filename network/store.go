@@ -0,0 +1,269 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultStateDir is where the network state of the containers is kept
+const DefaultStateDir = "/var/lib/rancher/state/cni"
+
+// Record is the network state of one start of a container
+type Record struct {
+	Attachments []*Attachment `json:"attachments,omitempty"`
+	// Pending are the attachments a failed network up was bringing up,
+	// they may hold IPAM leases until a DEL runs for them
+	Pending  []*Attachment `json:"pending,omitempty"`
+	Attempts []Attempt     `json:"attempts,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Retries  int           `json:"retries,omitempty"`
+	Failed   bool          `json:"failed,omitempty"`
+}
+
+// Attempt is one network up attempt, Error is empty if it succeeded
+type Attempt struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Entry is a record along with the container start it belongs to
+type Entry struct {
+	ContainerID string  `json:"containerId"`
+	StartedAt   string  `json:"startedAt"`
+	Record      *Record `json:"record"`
+}
+
+// primary returns the attachment of eth0
+func (r *Record) primary() *Attachment {
+	if len(r.Attachments) == 0 {
+		return nil
+	}
+	return r.Attachments[0]
+}
+
+// Networks returns the networks the container is attached to
+func (r *Record) Networks() []string {
+	networks := []string{}
+	for _, a := range r.Attachments {
+		networks = append(networks, a.Network)
+	}
+	return networks
+}
+
+// IPs returns the addresses of every interface of the container
+func (r *Record) IPs() []string {
+	ips := []string{}
+	for _, a := range r.Attachments {
+		for _, addr := range a.Result.Addresses(a.IfName) {
+			ips = append(ips, addr.String())
+		}
+	}
+	return ips
+}
+
+// Store reads and writes the records kept in the state dir, a dir per
+// container holding a file per start of the container
+type Store struct {
+	dir string
+}
+
+// NewStore returns a store backed by the given state dir
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Get returns the record of the given start of a container
+func (s *Store) Get(id, startedAt string) (*Record, error) {
+	content, err := ioutil.ReadFile(path.Join(s.dir, id, startedAt))
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Record{}
+	return record, json.Unmarshal(content, record)
+}
+
+// Put atomically writes the record of the given start of a container
+func (s *Store) Put(id, startedAt string, record *Record) error {
+	dir := path.Join(s.dir, id)
+	filename := path.Join(dir, startedAt)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshaling network data for %v: %v", filename, err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating network state dir for %v: %v", filename, err)
+	}
+
+	f, err := ioutil.TempFile(dir, "."+startedAt)
+	if err != nil {
+		return fmt.Errorf("creating network data temp file for %v: %v", filename, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("writing network data to temp file for %v: %v", filename, err)
+	}
+
+	if err := os.Rename(f.Name(), filename); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("renaming network data file for %v: %v", filename, err)
+	}
+
+	return nil
+}
+
+type start struct {
+	name string
+	time time.Time
+}
+
+// byStartTime sorts the records of a container, oldest first
+type byStartTime []start
+
+func (s byStartTime) Len() int           { return len(s) }
+func (s byStartTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStartTime) Less(i, j int) bool { return s[i].time.Before(s[j].time) }
+
+// History returns the records of a container, oldest first
+func (s *Store) History(id string) ([]Entry, error) {
+	files, err := ioutil.ReadDir(path.Join(s.dir, id))
+	if err != nil {
+		return nil, err
+	}
+
+	starts := byStartTime{}
+	for _, f := range files {
+		t, err := time.Parse(time.RFC3339Nano, f.Name())
+		if err != nil {
+			continue
+		}
+		starts = append(starts, start{f.Name(), t})
+	}
+	sort.Sort(starts)
+
+	entries := []Entry{}
+	for _, st := range starts {
+		record, err := s.Get(id, st.name)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, Entry{
+			ContainerID: id,
+			StartedAt:   st.name,
+			Record:      record,
+		})
+	}
+
+	return entries, nil
+}
+
+// Latest returns the record of the most recent start of a container
+func (s *Store) Latest(id string) (*Entry, error) {
+	entries, err := s.History(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return &entries[len(entries)-1], nil
+}
+
+// LegacyResult returns the CNI result of a record written by the versions
+// that stored the bare result of cniglue, without attachments
+func (s *Store) LegacyResult(id, startedAt string) (json.RawMessage, bool) {
+	content, err := ioutil.ReadFile(path.Join(s.dir, id, startedAt))
+	if err != nil {
+		return nil, false
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, false
+	}
+	if _, ok := fields["attachments"]; ok {
+		return nil, false
+	}
+	for _, key := range []string{"ip4", "ip6", "ips"} {
+		if _, ok := fields[key]; ok {
+			return json.RawMessage(content), true
+		}
+	}
+	return nil, false
+}
+
+// IDs returns the containers that have a state dir
+func (s *Store) IDs() ([]string, error) {
+	dirs, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			ids = append(ids, dir.Name())
+		}
+	}
+	return ids, nil
+}
+
+// List returns the latest record of every container
+func (s *Store) List() ([]Entry, error) {
+	ids, err := s.IDs()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+	for _, id := range ids {
+		if entry, err := s.Latest(id); err == nil {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+// Find resolves a container ID prefix to a full ID
+func (s *Store) Find(prefix string) (string, error) {
+	ids, err := s.IDs()
+	if err != nil {
+		return "", err
+	}
+
+	found := []string{}
+	for _, id := range ids {
+		if id == prefix {
+			return id, nil
+		}
+		if strings.HasPrefix(id, prefix) {
+			found = append(found, id)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no network state for container %s", prefix)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("container ID %s is ambiguous", prefix)
+	}
+}
+
+// Remove deletes all the records of a container
+func (s *Store) Remove(id string) error {
+	return os.RemoveAll(path.Join(s.dir, id))
+}
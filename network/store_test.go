@@ -0,0 +1,87 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewStore(dir)
+	for _, startedAt := range []string{"2017-03-01T10:00:00.5Z", "2017-03-01T09:00:00Z"} {
+		if err := s.Put("abcdef", startedAt, &Record{Error: startedAt}); err != nil {
+			t.Fatalf("putting %s: %v", startedAt, err)
+		}
+	}
+	if err := s.Put("abc123", "2017-03-01T08:00:00Z", &Record{}); err != nil {
+		t.Fatalf("putting: %v", err)
+	}
+
+	if info, err := os.Stat(path.Join(dir, "abcdef")); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("expected state dir with mode 0700, got %v, %v", info, err)
+	}
+
+	history, err := s.History("abcdef")
+	if err != nil {
+		t.Fatalf("reading history: %v", err)
+	}
+	if len(history) != 2 || history[0].StartedAt != "2017-03-01T09:00:00Z" || history[1].Record.Error != "2017-03-01T10:00:00.5Z" {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	latest, err := s.Latest("abcdef")
+	if err != nil || latest.StartedAt != "2017-03-01T10:00:00.5Z" {
+		t.Errorf("unexpected latest %+v, %v", latest, err)
+	}
+
+	if entries, err := s.List(); err != nil || len(entries) != 2 {
+		t.Errorf("expected 2 entries, got %+v, %v", entries, err)
+	}
+
+	if id, err := s.Find("abcd"); err != nil || id != "abcdef" {
+		t.Errorf("expected abcdef, got %s, %v", id, err)
+	}
+	if _, err := s.Find("abc"); err == nil {
+		t.Errorf("expected ambiguous prefix error")
+	}
+
+	if err := s.Remove("abcdef"); err != nil {
+		t.Fatalf("removing: %v", err)
+	}
+	if _, err := s.Latest("abcdef"); err == nil {
+		t.Errorf("expected no state after remove")
+	}
+}
+
+func TestLegacyResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewStore(dir)
+	legacy := `{"ip4":{"ip":"10.42.0.5/16","gateway":"10.42.0.1"},"dns":{}}`
+	os.MkdirAll(path.Join(dir, "legacy"), 0700)
+	ioutil.WriteFile(path.Join(dir, "legacy", "2017-03-01T08:00:00Z"), []byte(legacy), 0600)
+	if err := s.Put("current", "2017-03-01T08:00:00Z", &Record{Attachments: []*Attachment{{Network: "managed", IfName: "eth0"}}}); err != nil {
+		t.Fatalf("putting: %v", err)
+	}
+
+	if raw, ok := s.LegacyResult("legacy", "2017-03-01T08:00:00Z"); !ok || string(raw) != legacy {
+		t.Errorf("expected the legacy result, got %s, %v", raw, ok)
+	}
+	if _, ok := s.LegacyResult("current", "2017-03-01T08:00:00Z"); ok {
+		t.Errorf("expected a current record not to be legacy")
+	}
+	if latest, err := s.Latest("legacy"); err != nil || len(latest.Record.Attachments) != 0 {
+		t.Errorf("expected a legacy record without attachments, got %v, %v", latest, err)
+	}
+}
@@ -0,0 +1,100 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	// DefaultListenAddress is where the status API listens by default
+	DefaultListenAddress = "127.0.0.1:8119"
+	providers            = map[string]Provider{}
+	lock                 sync.RWMutex
+)
+
+// Provider returns the current status of a subsystem, it has to be
+// marshallable to JSON
+type Provider func() interface{}
+
+// Register makes the status of a subsystem available under /status/<name>
+func Register(name string, p Provider) {
+	lock.Lock()
+	defer lock.Unlock()
+	providers[name] = p
+}
+
+// ListenAndServe starts the status API in the background
+func ListenAndServe(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleAll)
+	mux.HandleFunc("/status/", handleOne)
+
+	go func() {
+		logrus.Infof("status: listening on %v", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			logrus.Errorf("status: failed to serve status API: %v", err)
+		}
+	}()
+}
+
+func handleAll(w http.ResponseWriter, r *http.Request) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	ret := map[string]interface{}{}
+	for name, p := range providers {
+		ret[name] = p()
+	}
+	writeJSON(w, ret)
+}
+
+func handleOne(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/status/")
+
+	lock.RLock()
+	p, ok := providers[name]
+	lock.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, p())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("status: failed to write response: %v", err)
+	}
+}
+
+// Get fetches the status of a subsystem, or of all of them when name is
+// empty, from a running plugin-manager
+func Get(address, name string) ([]byte, error) {
+	url := fmt.Sprintf("http://%s/status", address)
+	if name != "" {
+		url += "/" + name
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(content)))
+	}
+
+	return content, nil
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+var (
+	// CNIOverridesDir holds the per host overrides of the cniConfig of the
+	// networks, <network name>.json, applied as JSON merge patches. They
+	// are read on every sync, cniconf picks up changes on the next metadata
+	// change or periodic reapply.
+	CNIOverridesDir = "/etc/rancher/plugin-manager/cni-overrides"
+)
+
+// NetworkCNIConfig returns the cniConfig of a network for the given host:
+// the local override of the network merged in and the keywords replaced.
+// It returns nil if the network has no cniConfig.
+func NetworkCNIConfig(network metadata.Network, host metadata.Host) (map[string]interface{}, error) {
+	conf, ok := network.Metadata["cniConfig"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	override, err := cniOverride(network.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged interface{} = conf
+	if override != nil {
+		merged = MergePatch(conf, override)
+	}
+
+	ret, ok := UpdateCNIConfigByNetworkKeywords(merged, host, network).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("override of network %s doesn't leave a JSON object", network.Name)
+	}
+	return ret, nil
+}
+
+func cniOverride(name string) (interface{}, error) {
+	if name == "" || name != filepath.Base(name) {
+		return nil, nil
+	}
+
+	p := filepath.Join(CNIOverridesDir, name+".json")
+	content, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var override interface{}
+	if err := json.Unmarshal(content, &override); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", p, err)
+	}
+	return override, nil
+}
+
+// MergePatch returns the result of applying a JSON merge patch (RFC 7386)
+// to target. Neither target nor patch are modified.
+func MergePatch(target, patch interface{}) interface{} {
+	patchProps, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetProps, ok := target.(map[string]interface{})
+	ret := map[string]interface{}{}
+	if ok {
+		for k, v := range targetProps {
+			ret[k] = v
+		}
+	}
+
+	for k, v := range patchProps {
+		if v == nil {
+			delete(ret, k)
+			continue
+		}
+		ret[k] = MergePatch(ret[k], v)
+	}
+	return ret
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortRange is a range of ports, Start and End included. A single port
+// has the same Start and End.
+type PortRange struct {
+	Start int
+	End   int
+}
+
+func (r PortRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// IPTables returns the range in the syntax of iptables --dport
+func (r PortRange) IPTables() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return fmt.Sprintf("%d:%d", r.Start, r.End)
+}
+
+// Contains tells if the port, as a string, is in the range
+func (r PortRange) Contains(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p >= r.Start && p <= r.End
+}
+
+// Len returns the number of ports in the range
+func (r PortRange) Len() int {
+	return r.End - r.Start + 1
+}
+
+// PortDef is a port published by a container, as found in metadata like
+// 0.0.0.0:80:8080/tcp, [::]:8000-8010:8000-8010/udp or 8000-8010:8000-8010
+type PortDef struct {
+	HostIP     string
+	HostPort   PortRange
+	TargetPort PortRange
+	Protocol   string
+}
+
+// ParsePortDef parses and validates a port definition. The host IP
+// defaults to 0.0.0.0 and the protocol to tcp. The target is either a
+// single port or a range as long as the host one.
+func ParsePortDef(portDef string) (PortDef, error) {
+	def := PortDef{HostIP: "0.0.0.0", Protocol: "tcp"}
+
+	rest := portDef
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]:")
+		if end < 0 {
+			return PortDef{}, fmt.Errorf("invalid port %s", portDef)
+		}
+		def.HostIP, rest = rest[1:end], rest[end+2:]
+	} else if parts := strings.Split(rest, ":"); len(parts) == 3 {
+		def.HostIP, rest = parts[0], parts[1]+":"+parts[2]
+	}
+
+	if parts := strings.Split(rest, "/"); len(parts) == 2 {
+		rest, def.Protocol = parts[0], parts[1]
+	}
+
+	parts := strings.Split(rest, ":")
+	if len(parts) != 2 {
+		return PortDef{}, fmt.Errorf("invalid port %s", portDef)
+	}
+
+	if net.ParseIP(def.HostIP) == nil {
+		return PortDef{}, fmt.Errorf("invalid host IP in port %s", portDef)
+	}
+	if def.Protocol != "tcp" && def.Protocol != "udp" && def.Protocol != "sctp" {
+		return PortDef{}, fmt.Errorf("invalid protocol in port %s", portDef)
+	}
+
+	var err error
+	if def.HostPort, err = parsePortRange(parts[0]); err != nil {
+		return PortDef{}, fmt.Errorf("invalid host port in port %s: %v", portDef, err)
+	}
+	if def.TargetPort, err = parsePortRange(parts[1]); err != nil {
+		return PortDef{}, fmt.Errorf("invalid target port in port %s: %v", portDef, err)
+	}
+	if def.TargetPort.Len() != 1 && def.TargetPort.Len() != def.HostPort.Len() {
+		return PortDef{}, fmt.Errorf("host and target port ranges of %s don't have the same length", portDef)
+	}
+
+	return def, nil
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) > 2 {
+		return PortRange{}, fmt.Errorf("invalid range %s", s)
+	}
+
+	var ports []int
+	for _, part := range parts {
+		p, err := strconv.Atoi(part)
+		if err != nil || p < 1 || p > 65535 {
+			return PortRange{}, fmt.Errorf("invalid port %s", part)
+		}
+		ports = append(ports, p)
+	}
+
+	r := PortRange{Start: ports[0], End: ports[len(ports)-1]}
+	if r.Start > r.End {
+		return PortRange{}, fmt.Errorf("invalid range %s", s)
+	}
+	return r, nil
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/rancher/go-rancher-metadata/metadata"
@@ -10,33 +12,108 @@ const (
 	hostLabelKeyword = "__host_label__"
 )
 
+var (
+	// hostLabelRegexp matches __host_label__:<label>[|<default>], ended by
+	// __ or the end of the string
+	hostLabelRegexp = regexp.MustCompile(hostLabelKeyword + `(?::\s*(.*?)(?:\|(.*?))?)?(?:__|$)`)
+)
+
 // UpdateCNIConfigByKeywords takes in the given CNI config, replaces the rancher
 // specific keywords with the appropriate values.
 func UpdateCNIConfigByKeywords(config interface{}, host metadata.Host) interface{} {
-	props, isMap := config.(map[string]interface{})
-	if !isMap {
-		return config
+	return UpdateCNIConfigByNetworkKeywords(config, host, metadata.Network{})
+}
+
+// UpdateCNIConfigByNetworkKeywords returns a copy of the given CNI config
+// with the rancher specific keywords replaced, in maps, arrays and within
+// strings:
+//
+//	__host_label__:<label>[|<default>]  value of a host label
+//	__host_agent_ip__                   agent IP of the host
+//	__host_uuid__                       UUID of the host
+//	__hostname__                        hostname of the host
+//	__environment_uuid__                environment UUID of the host
+//	__network_uuid__                    UUID of the network
+//	__network_name__                    name of the network
+//
+// A host label keyword inside a string must be ended by __, as in
+// "10.42.__host_label__:subnet_octet|0__.0/24".
+func UpdateCNIConfigByNetworkKeywords(config interface{}, host metadata.Host, network metadata.Network) interface{} {
+	replacer := strings.NewReplacer(
+		"__host_agent_ip__", host.AgentIP,
+		"__host_uuid__", host.UUID,
+		"__hostname__", host.Hostname,
+		"__environment_uuid__", host.EnvironmentUUID,
+		"__network_uuid__", network.UUID,
+		"__network_name__", network.Name,
+	)
+	return updateByKeywords(config, host, replacer)
+}
+
+func updateByKeywords(config interface{}, host metadata.Host, replacer *strings.Replacer) interface{} {
+	switch v := config.(type) {
+	case map[string]interface{}:
+		props := make(map[string]interface{}, len(v))
+		for aKey, aValue := range v {
+			props[aKey] = updateByKeywords(aValue, host, replacer)
+		}
+		return props
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = updateByKeywords(item, host, replacer)
+		}
+		return items
+	case string:
+		return replacer.Replace(replaceHostLabels(v, host))
 	}
+	return config
+}
+
+func replaceHostLabels(v string, host metadata.Host) string {
+	if !strings.Contains(v, hostLabelKeyword) {
+		return v
+	}
+	return hostLabelRegexp.ReplaceAllStringFunc(v, func(keyword string) string {
+		m := hostLabelRegexp.FindStringSubmatch(keyword)
+		if labelValue := host.Labels[strings.TrimSpace(m[1])]; labelValue != "" {
+			return labelValue
+		}
+		return strings.TrimSpace(m[2])
+	})
+}
+
+// CNIPluginConfigs returns the plugin configurations of the given cniConfig,
+// sorted by file name. The plugins of .conflist entries are returned in
+// the order of the chain.
+func CNIPluginConfigs(cniConf map[string]interface{}) []map[string]interface{} {
+	files := []string{}
+	for file := range cniConf {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	ret := []map[string]interface{}{}
+	for _, file := range files {
+		props, ok := cniConf[file].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		plugins, ok := props["plugins"].([]interface{})
+		if !ok {
+			ret = append(ret, props)
+			continue
+		}
 
-	for aKey, aValue := range props {
-		if v, isString := aValue.(string); isString {
-			if strings.HasPrefix(v, hostLabelKeyword) {
-				props[aKey] = ""
-				splits := strings.SplitN(v, ":", 2)
-				if len(splits) > 1 {
-					label := strings.TrimSpace(splits[1])
-					labelValue := host.Labels[label]
-					if labelValue != "" {
-						props[aKey] = labelValue
-					}
-				}
+		for _, plugin := range plugins {
+			if pluginProps, ok := plugin.(map[string]interface{}); ok {
+				ret = append(ret, pluginProps)
 			}
-		} else {
-			props[aKey] = UpdateCNIConfigByKeywords(aValue, host)
 		}
 	}
 
-	return props
+	return ret
 }
 
 // IsContainerConsideredRunning function is used to test if the container is in any of
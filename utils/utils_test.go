@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestUpdateCNIConfigByNetworkKeywords(t *testing.T) {
+	config := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+  "bridge": "__host_label__: bridge",
+  "mtu": 1500,
+  "ipam": {
+    "subnet": "10.42.__host_label__:subnet_octet|0__.0/24",
+    "gateway": "__host_label__:gateway|10.42.0.1",
+    "routes": [{"dst": "0.0.0.0/0", "gw": "__host_label__:gateway|10.42.0.1"}],
+    "ranges": [["__host_label__:missing"]]
+  },
+  "name": "__network_name__-__hostname__",
+  "args": ["__host_agent_ip__", "__host_uuid__", "__environment_uuid__", "__network_uuid__"]
+}`), &config)
+	orig, _ := json.Marshal(config)
+
+	host := metadata.Host{
+		AgentIP:         "172.17.0.10",
+		UUID:            "host-uuid",
+		Hostname:        "node1",
+		EnvironmentUUID: "env-uuid",
+		Labels:          map[string]string{"bridge": "docker0", "subnet_octet": "7"},
+	}
+	network := metadata.Network{Name: "ipsec", UUID: "net-uuid"}
+
+	actual := UpdateCNIConfigByNetworkKeywords(config, host, network)
+
+	expected := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+  "bridge": "docker0",
+  "mtu": 1500,
+  "ipam": {
+    "subnet": "10.42.7.0/24",
+    "gateway": "10.42.0.1",
+    "routes": [{"dst": "0.0.0.0/0", "gw": "10.42.0.1"}],
+    "ranges": [[""]]
+  },
+  "name": "ipsec-node1",
+  "args": ["172.17.0.10", "host-uuid", "env-uuid", "net-uuid"]
+}`), &expected)
+	if !reflect.DeepEqual(actual, expected) {
+		a, _ := json.Marshal(actual)
+		t.Errorf("unexpected config %s", a)
+	}
+
+	if after, _ := json.Marshal(config); string(after) != string(orig) {
+		t.Errorf("the given config was modified: %s", after)
+	}
+}
+
+func TestValidateCNIPluginWrapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cnibin")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldProcDir := procDir
+	procDir = filepath.Join(dir, "proc")
+	defer func() { procDir = oldProcDir }()
+	os.MkdirAll(filepath.Join(procDir, "42"), 0700)
+
+	script := "#!/bin/sh\nexec /usr/bin/nsenter -m -u -i -n -p -t %d -- $0 \"$@\"\n"
+	ioutil.WriteFile(filepath.Join(dir, "rancher-bridge"), []byte(fmt.Sprintf(script, 42)), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "rancher-cni-ipam"), []byte(fmt.Sprintf(script, 43)), 0700)
+
+	plugin := map[string]interface{}{"type": "rancher-bridge"}
+	if err := ValidateCNIPlugin(plugin, []string{dir}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	plugin["ipam"] = map[string]interface{}{"type": "rancher-cni-ipam"}
+	if err := ValidateCNIPlugin(plugin, []string{dir}); err == nil {
+		t.Errorf("expected an error for a wrapper of a process that is gone")
+	}
+}
+
+func TestNetworkCNIConfigOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-overrides")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir := CNIOverridesDir
+	CNIOverridesDir = dir
+	defer func() { CNIOverridesDir = oldDir }()
+
+	conf := map[string]interface{}{}
+	json.Unmarshal([]byte(`{"10-rancher.conf": {
+  "type": "rancher-bridge",
+  "bridge": "docker0",
+  "hostNat": true,
+  "ipam": {"type": "rancher-cni-ipam", "subnet": "10.42.0.0/16", "routes": [{"dst": "0.0.0.0/0"}]}
+}}`), &conf)
+	network := metadata.Network{
+		Name:     "ipsec",
+		Metadata: map[string]interface{}{"cniConfig": conf},
+	}
+	host := metadata.Host{Labels: map[string]string{"bridge": "br-lan"}}
+
+	ioutil.WriteFile(filepath.Join(dir, "ipsec.json"), []byte(`{"10-rancher.conf": {
+  "bridge": "__host_label__:bridge",
+  "mtu": 1400,
+  "hostNat": null,
+  "ipam": {"subnet": "10.43.0.0/16", "routes": []}
+}}`), 0600)
+
+	actual, err := NetworkCNIConfig(network, host)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{}
+	json.Unmarshal([]byte(`{"10-rancher.conf": {
+  "type": "rancher-bridge",
+  "bridge": "br-lan",
+  "mtu": 1400,
+  "ipam": {"type": "rancher-cni-ipam", "subnet": "10.43.0.0/16", "routes": []}
+}}`), &expected)
+	if !reflect.DeepEqual(actual, expected) {
+		a, _ := json.Marshal(actual)
+		t.Errorf("unexpected config %s", a)
+	}
+	if conf["10-rancher.conf"].(map[string]interface{})["bridge"] != "docker0" {
+		t.Errorf("the metadata config was modified")
+	}
+
+	network.Name = "vxlan"
+	if actual, err := NetworkCNIConfig(network, host); err != nil || !reflect.DeepEqual(actual, conf) {
+		t.Errorf("expected the config unchanged without override, got %v, %v", actual, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "vxlan.json"), []byte(`{`), 0600)
+	if _, err := NetworkCNIConfig(network, host); err == nil {
+		t.Errorf("expected an error for an invalid override")
+	}
+}
+
+func TestParsePortDef(t *testing.T) {
+	tests := []struct {
+		portDef string
+		def     PortDef
+		err     bool
+	}{
+		{portDef: "0.0.0.0:80:8080/tcp", def: PortDef{"0.0.0.0", PortRange{80, 80}, PortRange{8080, 8080}, "tcp"}},
+		{portDef: "192.168.0.1:53:53/udp", def: PortDef{"192.168.0.1", PortRange{53, 53}, PortRange{53, 53}, "udp"}},
+		{portDef: "[::]:80:8080", def: PortDef{"::", PortRange{80, 80}, PortRange{8080, 8080}, "tcp"}},
+		{portDef: "8000-8010:8000-8010/udp", def: PortDef{"0.0.0.0", PortRange{8000, 8010}, PortRange{8000, 8010}, "udp"}},
+		{portDef: "0.0.0.0:8000-8010:80", def: PortDef{"0.0.0.0", PortRange{8000, 8010}, PortRange{80, 80}, "tcp"}},
+		{portDef: "0.0.0.0:8000-8010:9000-9005/udp", err: true},
+		{portDef: "0.0.0.0:8010-8000:8010-8000", err: true},
+		{portDef: "0.0.0.0:0:80", err: true},
+		{portDef: "0.0.0.0:80:70000", err: true},
+		{portDef: "0.0.0.0:80:80/icmp", err: true},
+		{portDef: "host:80:80", err: true},
+		{portDef: "80", err: true},
+	}
+	for _, test := range tests {
+		def, err := ParsePortDef(test.portDef)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.portDef, def)
+			}
+			continue
+		}
+		if err != nil || def != test.def {
+			t.Errorf("%s: expected %v, got %v, %v", test.portDef, test.def, def, err)
+		}
+	}
+
+	r := PortRange{8000, 8010}
+	if r.IPTables() != "8000:8010" || r.String() != "8000-8010" || !r.Contains("8005") || r.Contains("8011") {
+		t.Errorf("unexpected range %v", r)
+	}
+}
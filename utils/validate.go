@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+)
+
+var (
+	// SupportedCNIVersions are the CNI spec versions the plugin-manager can
+	// run, an empty version is run as 0.1.0
+	SupportedCNIVersions = []string{"", "0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0"}
+
+	// wrapperPIDRegexp finds the process a binexec wrapper enters
+	wrapperPIDRegexp = regexp.MustCompile(`nsenter .*-t (\d+)`)
+	procDir          = "/proc"
+)
+
+// ValidateCNIConfig checks a file of the cniConfig of a network, either a
+// single plugin or a conflist, before it's written out. The plugins and
+// their IPAM have to be found in path.
+func ValidateCNIConfig(file string, config interface{}, path []string) error {
+	props, ok := config.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: expected a JSON object, got %T", file, config)
+	}
+
+	if err := validateCNIVersion(props); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	rawPlugins, isConfList := props["plugins"]
+	if !isConfList {
+		if err := ValidateCNIPlugin(props, path); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		return nil
+	}
+
+	plugins, ok := rawPlugins.([]interface{})
+	if !ok || len(plugins) == 0 {
+		return fmt.Errorf("%s: plugins has to be a non empty array", file)
+	}
+	for i, plugin := range plugins {
+		pluginProps, ok := plugin.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: plugin %d: expected a JSON object, got %T", file, i, plugin)
+		}
+		if err := ValidateCNIPlugin(pluginProps, path); err != nil {
+			return fmt.Errorf("%s: plugin %d: %v", file, i, err)
+		}
+	}
+	return nil
+}
+
+// ValidateCNIPlugin checks the version, type and IPAM section of a plugin
+// configuration. Its binary, and the one of its IPAM, have to be found in
+// path.
+func ValidateCNIPlugin(plugin map[string]interface{}, path []string) error {
+	if err := validateCNIVersion(plugin); err != nil {
+		return err
+	}
+
+	if err := validateCNIBinary(plugin, path); err != nil {
+		return err
+	}
+
+	rawIPAM, ok := plugin["ipam"]
+	if !ok {
+		return nil
+	}
+	ipam, ok := rawIPAM.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("ipam: expected a JSON object, got %T", rawIPAM)
+	}
+	if err := validateCNIBinary(ipam, path); err != nil {
+		return fmt.Errorf("ipam: %v", err)
+	}
+	if err := validateIPAMRange(ipam); err != nil {
+		return fmt.Errorf("ipam: %v", err)
+	}
+
+	if routes, ok := ipam["routes"]; ok {
+		list, ok := routes.([]interface{})
+		if !ok {
+			return fmt.Errorf("ipam: routes has to be an array")
+		}
+		for _, route := range list {
+			r, ok := route.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("ipam: invalid route %v", route)
+			}
+			if err := validateField(r, "dst", true, isCIDR); err != nil {
+				return fmt.Errorf("ipam: route: %v", err)
+			}
+			if err := validateField(r, "gw", false, isIP); err != nil {
+				return fmt.Errorf("ipam: route: %v", err)
+			}
+		}
+	}
+
+	if ranges, ok := ipam["ranges"]; ok {
+		sets, ok := ranges.([]interface{})
+		if !ok {
+			return fmt.Errorf("ipam: ranges has to be an array of arrays")
+		}
+		for _, set := range sets {
+			list, ok := set.([]interface{})
+			if !ok {
+				return fmt.Errorf("ipam: ranges has to be an array of arrays")
+			}
+			for _, r := range list {
+				rangeProps, ok := r.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("ipam: invalid range %v", r)
+				}
+				if err := validateField(rangeProps, "subnet", true, isCIDR); err != nil {
+					return fmt.Errorf("ipam: range: %v", err)
+				}
+				if err := validateIPAMRange(rangeProps); err != nil {
+					return fmt.Errorf("ipam: range: %v", err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateCNIVersion(props map[string]interface{}) error {
+	rawVersion, ok := props["cniVersion"]
+	if !ok {
+		return nil
+	}
+	version, ok := rawVersion.(string)
+	if !ok {
+		return fmt.Errorf("cniVersion has to be a string")
+	}
+	for _, v := range SupportedCNIVersions {
+		if v == version {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported cniVersion %q", version)
+}
+
+func validateIPAMRange(props map[string]interface{}) error {
+	if err := validateField(props, "subnet", false, isCIDR); err != nil {
+		return err
+	}
+	for _, key := range []string{"rangeStart", "rangeEnd", "gateway"} {
+		if err := validateField(props, key, false, isIP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateField(props map[string]interface{}, key string, required bool, valid func(string) bool) error {
+	rawValue, ok := props[key]
+	if !ok {
+		if required {
+			return fmt.Errorf("missing %s", key)
+		}
+		return nil
+	}
+	if value, ok := rawValue.(string); !ok || !valid(value) {
+		return fmt.Errorf("invalid %s %v", key, rawValue)
+	}
+	return nil
+}
+
+func isCIDR(s string) bool {
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+func isIP(s string) bool {
+	return net.ParseIP(s) != nil
+}
+
+// validateCNIBinary checks that the binary of the type of a plugin or IPAM
+// exists. A binexec wrapper is only valid as long as the process it
+// enters is running.
+func validateCNIBinary(props map[string]interface{}, path []string) error {
+	pluginType, _ := props["type"].(string)
+	if pluginType == "" {
+		return fmt.Errorf("missing type")
+	}
+	if pluginType != filepath.Base(pluginType) {
+		return fmt.Errorf("invalid type %q", pluginType)
+	}
+
+	binary, err := invoke.FindInPath(pluginType, path)
+	if err != nil {
+		return fmt.Errorf("no binary for type %q in %s", pluginType, strings.Join(path, ":"))
+	}
+
+	f, err := os.Open(binary)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", binary, err)
+	}
+	defer f.Close()
+
+	// Wrappers are short scripts, no need to read the real binaries
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	content := string(head[:n])
+	if !strings.HasPrefix(content, "#!") {
+		return nil
+	}
+	if m := wrapperPIDRegexp.FindStringSubmatch(content); m != nil {
+		if _, err := os.Stat(filepath.Join(procDir, m[1])); err != nil {
+			return fmt.Errorf("binary %s for type %q enters process %s which is gone", binary, pluginType, m[1])
+		}
+	}
+	return nil
+}
@@ -13,6 +13,7 @@ import (
 	//"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/plugin-manager/network"
+	"github.com/rancher/plugin-manager/utils"
 	"github.com/vishvananda/netlink"
 )
 
@@ -37,10 +38,20 @@ func GetHostViewVethMap(vethPrefix string, mc metadata.Client) (map[string]*netl
 		return veths, nil
 	}
 
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		logrus.Errorf("vethsync/utils: error fetching self host: %v", err)
+		return nil, err
+	}
+
 	localBridges := make(map[string]bool)
 	for _, n := range localNetworks {
-		cniConf, ok := n.Metadata["cniConfig"].(map[string]interface{})
-		if !ok {
+		cniConf, err := utils.NetworkCNIConfig(n, host)
+		if err != nil {
+			logrus.Errorf("vethsync/utils: error getting the cni config of network %v: %v", n.UUID, err)
+			continue
+		}
+		if cniConf == nil {
 			continue
 		}
 
@@ -81,27 +92,21 @@ func GetHostViewVethMap(vethPrefix string, mc metadata.Client) (map[string]*netl
 }
 
 func getBridgeInfoFromCNIConfig(cniConf map[string]interface{}) (string, error) {
-	var lastErr error
 	var bridge string
-	for _, config := range cniConf {
-		props, ok := config.(map[string]interface{})
-		if !ok {
-			err := fmt.Errorf("error getting props from cni config")
-			logrus.Errorf("vethsync/utils: %v", err)
-			lastErr = err
-			continue
-		}
-		bridge, ok = props["bridge"].(string)
-		if !ok {
-			err := fmt.Errorf("error getting bridge from cni config")
-			logrus.Errorf("vethsync/utils: %v", err)
-			lastErr = err
-			continue
+	for _, props := range utils.CNIPluginConfigs(cniConf) {
+		if b, ok := props["bridge"].(string); ok {
+			bridge = b
 		}
 	}
 
+	if bridge == "" {
+		err := fmt.Errorf("error getting bridge from cni config")
+		logrus.Errorf("vethsync/utils: %v", err)
+		return "", err
+	}
+
 	logrus.Debugf("vethsync/utils: bridge: %v", bridge)
-	return bridge, lastErr
+	return bridge, nil
 }
 
 // GetContainersViewVethMapByEnteringNS returns a map of veth indices as seen